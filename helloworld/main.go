@@ -24,6 +24,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -37,10 +38,15 @@ import (
 	"github.com/lni/dragonboat/v4/config"
 	"github.com/lni/dragonboat/v4/logger"
 	"github.com/lni/goutils/syncutil"
+
+	"github.com/lni/dragonboat-example/v3/status"
 )
 
 const (
 	exampleShardID uint64 = 128
+	// catchUpRetries is the number of timed out reads tolerated while waiting
+	// for a non-voting replica to catch up before promoting it
+	catchUpRetries = 10
 )
 
 var (
@@ -62,6 +68,10 @@ func makeMembershipChange(nh *dragonboat.NodeHost,
 	if cmd == "add" {
 		// orderID is ignored in standalone mode
 		rs, err = nh.RequestAddReplica(exampleShardID, replicaID, addr, 0, 3*time.Second)
+	} else if cmd == "add-nonvoting" {
+		rs, err = nh.RequestAddNonVoting(exampleShardID, replicaID, addr, 0, 3*time.Second)
+	} else if cmd == "add-witness" {
+		rs, err = nh.RequestAddWitness(exampleShardID, replicaID, addr, 0, 3*time.Second)
 	} else if cmd == "remove" {
 		rs, err = nh.RequestDeleteReplica(exampleShardID, replicaID, 0, 3*time.Second)
 	} else {
@@ -81,27 +91,78 @@ func makeMembershipChange(nh *dragonboat.NodeHost,
 	}
 }
 
+// promoteNonVoting promotes the local non-voting replica to a full member once
+// it has caught up with the rest of the shard. A linearizable read only
+// completes after the local replica applied all entries committed when the
+// read was requested, so a successful read tells the replica is no longer
+// lagging behind. The progress of other replicas can't be observed from here,
+// so the promote command has to be entered on the node being promoted.
+func promoteNonVoting(nh *dragonboat.NodeHost, localReplicaID uint64, replicaID uint64) {
+	if replicaID != localReplicaID {
+		fmt.Fprintf(os.Stderr, "replica %d can only be promoted on its own node\n", replicaID)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	m, err := nh.SyncGetShardMembership(ctx, exampleShardID)
+	cancel()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get the membership, %v\n", err)
+		return
+	}
+	addr, ok := m.NonVotings[replicaID]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "replica %d is not a non-voting replica\n", replicaID)
+		return
+	}
+	for i := 0; ; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		_, err := nh.SyncRead(ctx, exampleShardID, []byte{})
+		cancel()
+		if err == nil {
+			break
+		}
+		if i == catchUpRetries {
+			fmt.Fprintf(os.Stderr, "replica %d failed to catch up, %v\n", replicaID, err)
+			return
+		}
+		fmt.Fprintf(os.Stdout, "waiting for replica %d to catch up\n", replicaID)
+	}
+	// adding a non-voting replica as a regular replica promotes it
+	makeMembershipChange(nh, "add", addr, replicaID)
+}
+
 // splitMembershipChangeCmd tries to parse the input string as membership change
 // request. ADD node request has the following expected format -
 // add localhost:63100 4
+// non-voting and witness replicas are added in the same way using the
+// add-nonvoting and add-witness commands.
 // REMOVE node request has the following expected format -
 // remove 4
+// PROMOTE request which turns a non-voting replica into a regular one has the
+// following expected format -
+// promote 4
 func splitMembershipChangeCmd(v string) (string, string, uint64, error) {
 	parts := strings.Split(v, " ")
 	if len(parts) == 2 || len(parts) == 3 {
 		cmd := strings.ToLower(strings.TrimSpace(parts[0]))
-		if cmd != "add" && cmd != "remove" {
-			return "", "", 0, errNotMembershipChange
-		}
 		addr := ""
 		var replicaIDStr string
 		var replicaID uint64
 		var err error
-		if cmd == "add" {
+		switch cmd {
+		case "add", "add-nonvoting", "add-witness":
+			if len(parts) != 3 {
+				return "", "", 0, errNotMembershipChange
+			}
 			addr = strings.TrimSpace(parts[1])
 			replicaIDStr = strings.TrimSpace(parts[2])
-		} else {
+		case "remove", "promote":
+			if len(parts) != 2 {
+				return "", "", 0, errNotMembershipChange
+			}
 			replicaIDStr = strings.TrimSpace(parts[1])
+		default:
+			return "", "", 0, errNotMembershipChange
 		}
 		if replicaID, err = strconv.ParseUint(replicaIDStr, 10, 64); err != nil {
 			return "", "", 0, errNotMembershipChange
@@ -115,11 +176,27 @@ func main() {
 	replicaID := flag.Int("replicaid", 1, "ReplicaID to use")
 	addr := flag.String("addr", "", "Nodehost address")
 	join := flag.Bool("join", false, "Joining a new node")
+	nonVoting := flag.Bool("nonvoting", false, "Joining as a non-voting node, requires -join")
+	witness := flag.Bool("witness", false, "Joining as a witness node, requires -join")
+	caFile := flag.String("ca-file", "",
+		"CA certificate file, enables mutual TLS together with -cert-file and -key-file")
+	certFile := flag.String("cert-file", "", "Certificate file of the NodeHost")
+	keyFile := flag.String("key-file", "", "Key file of the NodeHost")
+	statusAddr := flag.String("status-addr", "",
+		"Address to serve the /healthz, /readyz and /status endpoints on")
 	flag.Parse()
 	if len(*addr) == 0 && *replicaID != 1 && *replicaID != 2 && *replicaID != 3 {
 		fmt.Fprintf(os.Stderr, "node id must be 1, 2 or 3 when address is not specified\n")
 		os.Exit(1)
 	}
+	if (*nonVoting || *witness) && !*join {
+		fmt.Fprintf(os.Stderr, "-nonvoting and -witness require -join\n")
+		os.Exit(1)
+	}
+	if *nonVoting && *witness {
+		fmt.Fprintf(os.Stderr, "-nonvoting and -witness can't be used together\n")
+		os.Exit(1)
+	}
 	// https://github.com/golang/go/issues/17393
 	if runtime.GOOS == "darwin" {
 		signal.Ignore(syscall.Signal(0xd))
@@ -186,6 +263,15 @@ func main() {
 		// entries, the leaders can send them regular entries rather than the full
 		// snapshot image.
 		CompactionOverhead: 5,
+		// IsNonVoting and IsWitness set the role of a node joining as a non-voting
+		// or witness replica, they must match the role the node was added with.
+		// A promoted non-voting node is restarted without -nonvoting.
+		IsNonVoting: *nonVoting,
+		IsWitness:   *witness,
+	}
+	if *witness {
+		// witness replicas have no state machine data to capture in snapshots
+		rc.SnapshotEntries = 0
 	}
 	datadir := filepath.Join(
 		"example-data",
@@ -197,7 +283,8 @@ func main() {
 	// Authentication to authenticate both servers and clients. To use Mutual
 	// TLS Authentication, set the MutualTLS field in NodeHostConfig to true, set
 	// the CAFile, CertFile and KeyFile fields to point to the path of your CA
-	// file, certificate and key files.
+	// file, certificate and key files. In this example, they are set below when
+	// the -ca-file, -cert-file and -key-file flags are specified.
 	nhc := config.NodeHostConfig{
 		// WALDir is the directory to store the WAL of all Raft Logs. It is
 		// recommended to use Enterprise SSDs with good fsync() performance
@@ -232,6 +319,12 @@ func main() {
 		// RaftAddress is used to identify the NodeHost instance
 		RaftAddress: nodeAddr,
 	}
+	if len(*caFile) > 0 || len(*certFile) > 0 || len(*keyFile) > 0 {
+		nhc.MutualTLS = true
+		nhc.CAFile = *caFile
+		nhc.CertFile = *certFile
+		nhc.KeyFile = *keyFile
+	}
 	nh, err := dragonboat.NewNodeHost(nhc)
 	if err != nil {
 		panic(err)
@@ -240,6 +333,14 @@ func main() {
 		fmt.Fprintf(os.Stderr, "failed to add cluster, %v\n", err)
 		os.Exit(1)
 	}
+	if len(*statusAddr) > 0 {
+		go func() {
+			h := &status.Handler{NodeHost: nh}
+			if err := http.ListenAndServe(*statusAddr, h); err != nil {
+				fmt.Fprintf(os.Stderr, "status server failed, %v\n", err)
+			}
+		}()
+	}
 	raftStopper := syncutil.NewStopper()
 	consoleStopper := syncutil.NewStopper()
 	ch := make(chan string, 16)
@@ -294,7 +395,11 @@ func main() {
 				msg := strings.Replace(v, "\n", "", 1)
 				if cmd, addr, replicaID, err := splitMembershipChangeCmd(msg); err == nil {
 					// input is a membership change request
-					makeMembershipChange(nh, cmd, addr, replicaID)
+					if cmd == "promote" {
+						promoteNonVoting(nh, rc.ReplicaID, replicaID)
+					} else {
+						makeMembershipChange(nh, cmd, addr, replicaID)
+					}
 				} else {
 					// input is a regular message need to be proposed
 					ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
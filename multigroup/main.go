@@ -23,6 +23,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -35,6 +36,8 @@ import (
 	"github.com/lni/dragonboat/v4/config"
 	"github.com/lni/dragonboat/v4/logger"
 	"github.com/lni/goutils/syncutil"
+
+	"github.com/lni/dragonboat-example/v3/status"
 )
 
 const (
@@ -56,6 +59,12 @@ var (
 
 func main() {
 	replicaID := flag.Int("nodeid", 1, "ReplicaID to use")
+	caFile := flag.String("ca-file", "",
+		"CA certificate file, enables mutual TLS together with -cert-file and -key-file")
+	certFile := flag.String("cert-file", "", "Certificate file of the NodeHost")
+	keyFile := flag.String("key-file", "", "Key file of the NodeHost")
+	statusAddr := flag.String("status-addr", "",
+		"Address to serve the /healthz, /readyz and /status endpoints on")
 	flag.Parse()
 	if *replicaID > 3 || *replicaID < 1 {
 		fmt.Fprintf(os.Stderr, "invalid nodeid %d, it must be 1, 2 or 3", *replicaID)
@@ -97,7 +106,8 @@ func main() {
 	// Authentication to authenticate both servers and clients. To use Mutual
 	// TLS Authentication, set the MutualTLS field in NodeHostConfig to true, set
 	// the CAFile, CertFile and KeyFile fields to point to the path of your CA
-	// file, certificate and key files.
+	// file, certificate and key files. In this example, they are set below when
+	// the -ca-file, -cert-file and -key-file flags are specified.
 	// by default, TCP based RPC module is used, set the RaftRPCFactory field in
 	// NodeHostConfig to rpc.NewRaftGRPC (github.com/lni/dragonboat/plugin/rpc) to
 	// use gRPC based transport. To use gRPC based RPC module, you need to install
@@ -112,6 +122,12 @@ func main() {
 		RaftAddress:    nodeAddr,
 		// RaftRPCFactory: rpc.NewRaftGRPC,
 	}
+	if len(*caFile) > 0 || len(*certFile) > 0 || len(*keyFile) > 0 {
+		nhc.MutualTLS = true
+		nhc.CAFile = *caFile
+		nhc.CertFile = *certFile
+		nhc.KeyFile = *keyFile
+	}
 	// create a NodeHost instance. it is a facade interface allowing access to
 	// all functionalities provided by dragonboat.
 	nh, err := dragonboat.NewNodeHost(nhc)
@@ -134,6 +150,14 @@ func main() {
 		fmt.Fprintf(os.Stderr, "failed to add cluster, %v\n", err)
 		os.Exit(1)
 	}
+	if len(*statusAddr) > 0 {
+		go func() {
+			h := &status.Handler{NodeHost: nh}
+			if err := http.ListenAndServe(*statusAddr, h); err != nil {
+				fmt.Fprintf(os.Stderr, "status server failed, %v\n", err)
+			}
+		}()
+	}
 	raftStopper := syncutil.NewStopper()
 	consoleStopper := syncutil.NewStopper()
 	ch := make(chan string, 16)
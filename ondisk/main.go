@@ -23,6 +23,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -35,6 +36,8 @@ import (
 	"github.com/lni/dragonboat/v4/config"
 	"github.com/lni/dragonboat/v4/logger"
 	"github.com/lni/goutils/syncutil"
+
+	"github.com/lni/dragonboat-example/v3/status"
 )
 
 type RequestType uint64
@@ -84,6 +87,12 @@ func main() {
 	replicaID := flag.Int("replicaid", 1, "ReplicaID to use")
 	addr := flag.String("addr", "", "Nodehost address")
 	join := flag.Bool("join", false, "Joining a new node")
+	caFile := flag.String("ca-file", "",
+		"CA certificate file, enables mutual TLS together with -cert-file and -key-file")
+	certFile := flag.String("cert-file", "", "Certificate file of the NodeHost")
+	keyFile := flag.String("key-file", "", "Key file of the NodeHost")
+	statusAddr := flag.String("status-addr", "",
+		"Address to serve the /healthz, /readyz and /status endpoints on")
 	flag.Parse()
 	if len(*addr) == 0 && *replicaID != 1 && *replicaID != 2 && *replicaID != 3 {
 		fmt.Fprintf(os.Stderr, "replica id must be 1, 2 or 3 when address is not specified\n")
@@ -123,12 +132,20 @@ func main() {
 		"example-data",
 		"helloworld-data",
 		fmt.Sprintf("node%d", *replicaID))
+	// Mutual TLS is used for the Raft transport when the -ca-file, -cert-file
+	// and -key-file flags are specified.
 	nhc := config.NodeHostConfig{
 		WALDir:         datadir,
 		NodeHostDir:    datadir,
 		RTTMillisecond: 200,
 		RaftAddress:    nodeAddr,
 	}
+	if len(*caFile) > 0 || len(*certFile) > 0 || len(*keyFile) > 0 {
+		nhc.MutualTLS = true
+		nhc.CAFile = *caFile
+		nhc.CertFile = *certFile
+		nhc.KeyFile = *keyFile
+	}
 	nh, err := dragonboat.NewNodeHost(nhc)
 	if err != nil {
 		panic(err)
@@ -137,6 +154,14 @@ func main() {
 		fmt.Fprintf(os.Stderr, "failed to add cluster, %v\n", err)
 		os.Exit(1)
 	}
+	if len(*statusAddr) > 0 {
+		go func() {
+			h := &status.Handler{NodeHost: nh}
+			if err := http.ListenAndServe(*statusAddr, h); err != nil {
+				fmt.Fprintf(os.Stderr, "status server failed, %v\n", err)
+			}
+		}()
+	}
 	raftStopper := syncutil.NewStopper()
 	consoleStopper := syncutil.NewStopper()
 	ch := make(chan string, 16)
@@ -0,0 +1,290 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// aclPrefix is the reserved key space holding the ACL table, each principal
+	// is stored as the JSON encoded value of aclPrefix + name.
+	aclPrefix = "/_acl/"
+)
+
+var (
+	ErrUnauthenticated  = errors.New("Unauthenticated")
+	ErrPermissionDenied = errors.New("Permission denied")
+
+	errLastAdmin = errors.New("The last admin can't be removed")
+)
+
+// Permission grants read and/or write access to all keys starting with
+// Prefix.
+type Permission struct {
+	Prefix string `json:"prefix"`
+	Read   bool   `json:"read,omitempty"`
+	Write  bool   `json:"write,omitempty"`
+}
+
+// Principal is an API user identified by a bearer token. Only the SHA-256 hash
+// of the token is stored. Admins can access all keys and change the ACL.
+type Principal struct {
+	Name        string       `json:"name"`
+	TokenHash   string       `json:"token_hash,omitempty"`
+	Admin       bool         `json:"admin,omitempty"`
+	Permissions []Permission `json:"permissions,omitempty"`
+}
+
+// ACLQuery returns all principals when made by an admin.
+type ACLQuery struct {
+	Token string
+}
+
+// AdminQuery fails unless made by an admin.
+type AdminQuery struct {
+	Token string
+}
+
+func hashToken(token string) string {
+	if len(token) == 0 {
+		return ""
+	}
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func isReserved(key string) bool {
+	return strings.HasPrefix(key, aclPrefix) || strings.HasPrefix(key, lockPrefix) ||
+		strings.HasPrefix(key, catalogPrefix)
+}
+
+func (p Principal) validate() error {
+	if len(p.Name) == 0 || strings.Contains(p.Name, "/") {
+		return fmt.Errorf("Invalid principal name %q", p.Name)
+	}
+	if len(p.TokenHash) == 0 {
+		return fmt.Errorf("Missing token")
+	}
+	return nil
+}
+
+func (p Principal) allowed(key string, write bool) bool {
+	// the reserved key space is only changed by the ACL commands
+	if isReserved(key) {
+		return false
+	}
+	if p.Admin {
+		return true
+	}
+	for _, perm := range p.Permissions {
+		if strings.HasPrefix(key, perm.Prefix) && ((write && perm.Write) || (!write && perm.Read)) {
+			return true
+		}
+	}
+	return false
+}
+
+// principal returns the principal owning token. Access control is disabled
+// until the first principal is added, all requests are then made by an
+// anonymous admin. Namespace shards created with access control enabled start
+// with their owner as the first principal.
+func (fsm *linearizableFSM) principal(token string) (Principal, error) {
+	if len(fsm.principals) == 0 {
+		return Principal{Admin: true}, nil
+	}
+	p, ok := fsm.principals[token]
+	if !ok {
+		return p, ErrUnauthenticated
+	}
+	return p, nil
+}
+
+// authorize checks whether the principal owning token may access all keys.
+func (fsm *linearizableFSM) authorize(token string, write bool, keys ...string) error {
+	p, err := fsm.principal(token)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if !p.allowed(key, write) {
+			return ErrPermissionDenied
+		}
+	}
+	return nil
+}
+
+func (fsm *linearizableFSM) authorizeTxn(token string, txn *Txn) error {
+	var reads, writes []string
+	for _, c := range txn.Compare {
+		reads = append(reads, c.Key)
+	}
+	for _, ops := range [][]Op{txn.Then, txn.Else} {
+		for _, op := range ops {
+			if op.Type == OpTypeGet {
+				reads = append(reads, op.Key)
+			} else {
+				writes = append(writes, op.Key)
+			}
+		}
+	}
+	if err := fsm.authorize(token, false, reads...); err != nil {
+		return err
+	}
+	return fsm.authorize(token, true, writes...)
+}
+
+// rebuildACL rebuilds the token index from the ACL table. The owner is
+// indexed unless the table holds a principal with the same name, which
+// replaces it.
+func (fsm *linearizableFSM) rebuildACL() {
+	fsm.principals = fsm.aclPrincipals("", nil)
+}
+
+// aclPrincipals returns the principals of the shard by token hash with the
+// principal named name replaced by p, or removed when p is nil.
+func (fsm *linearizableFSM) aclPrincipals(name string, p *Principal) map[string]Principal {
+	principals := map[string]Principal{}
+	owned := fsm.owner != nil
+	add := func(p Principal) {
+		principals[p.TokenHash] = p
+		owned = owned && p.Name != fsm.owner.Name
+	}
+	for _, entry := range fsm.scan(aclPrefix) {
+		var other Principal
+		if err := json.Unmarshal([]byte(entry.Val), &other); err == nil && other.Name != name {
+			add(other)
+		}
+	}
+	if p != nil {
+		add(*p)
+	}
+	if owned {
+		if _, ok := principals[fsm.owner.TokenHash]; !ok {
+			principals[fsm.owner.TokenHash] = *fsm.owner
+		}
+	}
+	return principals
+}
+
+// hasAdmin returns whether one of principals is an admin.
+func hasAdmin(principals map[string]Principal) bool {
+	for _, p := range principals {
+		if p.Admin {
+			return true
+		}
+	}
+	return false
+}
+
+// scan returns all entries with keys starting with prefix.
+func (fsm *linearizableFSM) scan(prefix string) []Entry {
+	var entries []Entry
+	fsm.store.scan(prefix, func(entry Entry) bool {
+		if !strings.HasPrefix(entry.Key, prefix) {
+			return false
+		}
+		entries = append(entries, entry)
+		return true
+	})
+	return entries
+}
+
+func (fsm *linearizableFSM) setPrincipal(cmd Command, index uint64) (uint64, []byte) {
+	p, err := fsm.principal(cmd.Token)
+	if err != nil {
+		return ResultCodeUnauthenticated, []byte(err.Error())
+	}
+	if !p.Admin {
+		return ResultCodePermissionDenied, []byte(ErrPermissionDenied.Error())
+	}
+	var principal Principal
+	if err := json.Unmarshal([]byte(cmd.Val), &principal); err != nil {
+		return ResultCodeFailure, []byte(err.Error())
+	}
+	if err := principal.validate(); err != nil {
+		return ResultCodeFailure, []byte(err.Error())
+	}
+	if len(fsm.principals) == 0 && !principal.Admin {
+		return ResultCodeFailure, []byte("The first principal must be an admin")
+	}
+	if other, ok := fsm.principals[principal.TokenHash]; ok && other.Name != principal.Name {
+		return ResultCodeFailure, []byte("Token already in use")
+	}
+	if !hasAdmin(fsm.aclPrincipals(principal.Name, &principal)) {
+		return ResultCodeLastAdmin, []byte(errLastAdmin.Error())
+	}
+	entry := Entry{Key: aclPrefix + principal.Name, Ver: index, Val: cmd.Val}
+	fsm.set(entry)
+	fsm.rebuildACL()
+	principal.TokenHash = ""
+	b, _ := json.Marshal(principal)
+	return ResultCodeSuccess, b
+}
+
+func (fsm *linearizableFSM) deletePrincipal(cmd Command) (uint64, []byte) {
+	p, err := fsm.principal(cmd.Token)
+	if err != nil {
+		return ResultCodeUnauthenticated, []byte(err.Error())
+	}
+	if !p.Admin {
+		return ResultCodePermissionDenied, []byte(ErrPermissionDenied.Error())
+	}
+	key := aclPrefix + cmd.Key
+	if _, ok := fsm.store.get(key); !ok {
+		return ResultCodeNotFound, nil
+	}
+	// access control can't be disabled once enabled, and it would be when the
+	// last principal is removed
+	if !hasAdmin(fsm.aclPrincipals(cmd.Key, nil)) {
+		return ResultCodeLastAdmin, []byte(errLastAdmin.Error())
+	}
+	fsm.remove(key)
+	fsm.rebuildACL()
+	return ResultCodeSuccess, nil
+}
+
+// requireAdmin returns an error unless token is owned by an admin.
+func (fsm *linearizableFSM) requireAdmin(token string) error {
+	p, err := fsm.principal(token)
+	if err != nil {
+		return err
+	}
+	if !p.Admin {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// listPrincipals returns all principals without their token hashes.
+func (fsm *linearizableFSM) listPrincipals(token string) (interface{}, error) {
+	if err := fsm.requireAdmin(token); err != nil {
+		return nil, err
+	}
+	principals := []Principal{}
+	for _, entry := range fsm.scan(aclPrefix) {
+		var p Principal
+		if err := json.Unmarshal([]byte(entry.Val), &p); err == nil {
+			p.TokenHash = ""
+			principals = append(principals, p)
+		}
+	}
+	return principals, nil
+}
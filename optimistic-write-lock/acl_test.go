@@ -0,0 +1,82 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func setPrincipal(sm *testFSM, p Principal, token string) uint64 {
+	b, _ := json.Marshal(p)
+	cmd := Command{Type: CommandTypeSetPrincipal, Entry: Entry{Val: string(b)}, Token: hashToken(token)}
+	return sm.propose(cmd).Value
+}
+
+func deletePrincipal(sm *testFSM, name string, token string) uint64 {
+	cmd := Command{Type: CommandTypeDeletePrincipal, Entry: Entry{Key: name}, Token: hashToken(token)}
+	return sm.propose(cmd).Value
+}
+
+func TestDeleteLastPrincipal(t *testing.T) {
+	forEachStore(t, historyOptions{}, func(t *testing.T, sm *testFSM) {
+		root := Principal{Name: "root", TokenHash: hashToken("secret"), Admin: true}
+		if code := setPrincipal(sm, root, ""); code != ResultCodeSuccess {
+			t.Fatalf("failed to set the first principal, %d", code)
+		}
+		if code := deletePrincipal(sm, "root", "secret"); code != ResultCodeLastAdmin {
+			t.Errorf("deleting the last principal returned %d", code)
+		}
+		// access control is still enabled
+		if code := sm.propose(Command{Entry: Entry{Key: "/a", Val: "1"}}).Value; code != ResultCodeUnauthenticated {
+			t.Errorf("anonymous put returned %d", code)
+		}
+	})
+}
+
+func TestDeleteLastAdmin(t *testing.T) {
+	forEachStore(t, historyOptions{}, func(t *testing.T, sm *testFSM) {
+		root := Principal{Name: "root", TokenHash: hashToken("secret"), Admin: true}
+		alice := Principal{
+			Name:        "alice",
+			TokenHash:   hashToken("alice-token"),
+			Permissions: []Permission{{Prefix: "/alice/", Read: true, Write: true}},
+		}
+		if code := setPrincipal(sm, root, ""); code != ResultCodeSuccess {
+			t.Fatalf("failed to set root, %d", code)
+		}
+		if code := setPrincipal(sm, alice, "secret"); code != ResultCodeSuccess {
+			t.Fatalf("failed to set alice, %d", code)
+		}
+		if code := deletePrincipal(sm, "root", "secret"); code != ResultCodeLastAdmin {
+			t.Errorf("deleting the last admin returned %d", code)
+		}
+		root.Admin = false
+		if code := setPrincipal(sm, root, "secret"); code != ResultCodeLastAdmin {
+			t.Errorf("demoting the last admin returned %d", code)
+		}
+		// admins other than the last one can be removed
+		bob := Principal{Name: "bob", TokenHash: hashToken("bob-token"), Admin: true}
+		if code := setPrincipal(sm, bob, "secret"); code != ResultCodeSuccess {
+			t.Fatalf("failed to set bob, %d", code)
+		}
+		if code := deletePrincipal(sm, "root", "bob-token"); code != ResultCodeSuccess {
+			t.Errorf("deleting root returned %d", code)
+		}
+		if code := deletePrincipal(sm, "alice", "bob-token"); code != ResultCodeSuccess {
+			t.Errorf("deleting alice returned %d", code)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// appliedIndex tracks the index of the last entry applied by the local
+// replica, readers can wait for it to reach the index of an earlier write.
+type appliedIndex struct {
+	mu    sync.Mutex
+	index uint64
+	// ch is closed and replaced each time the index advances
+	ch chan struct{}
+}
+
+func newAppliedIndex() *appliedIndex {
+	return &appliedIndex{ch: make(chan struct{})}
+}
+
+// advance records that all entries up to index have been applied.
+func (a *appliedIndex) advance(index uint64) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if index <= a.index {
+		return
+	}
+	a.index = index
+	close(a.ch)
+	a.ch = make(chan struct{})
+}
+
+// next returns a channel closed once the index advances.
+func (a *appliedIndex) next() <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.ch
+}
+
+// wait blocks until the applied index reaches index or ctx is done.
+func (a *appliedIndex) wait(ctx context.Context, index uint64) error {
+	for {
+		a.mu.Lock()
+		current, ch := a.index, a.ch
+		a.mu.Unlock()
+		if current >= index {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package client is a Go client of the optimistic-write-lock HTTP API.
+
+Requests are sent to the current leader of the shard when it is known from
+the X-Raft-Leader header of earlier responses, and to the next configured
+endpoint when a node can't be reached. Unavailable nodes are retried with
+exponential backoff, Update retries its read-modify-write loop the same way
+when the key was changed concurrently. Writes that may have been applied, e.g.
+when they timed out, are not retried as their outcome is unknown.
+*/
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerLeader  = "X-Raft-Leader"
+	headerTimeout = "X-Request-Timeout"
+	// maxTimeout is the longest request timeout accepted by the server
+	maxTimeout = 30 * time.Second
+	// codeNotLeader is the error code of requests rejected by a follower
+	// before being proposed
+	codeNotLeader = "not_leader"
+)
+
+var (
+	ErrNotFound = errors.New("key not found")
+	// ErrVersionMismatch is matched by all *VersionMismatchError values.
+	ErrVersionMismatch  = errors.New("version mismatch")
+	ErrUnauthenticated  = errors.New("unauthenticated")
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrTooManyRetries is returned once Config.MaxRetries retries failed.
+	ErrTooManyRetries = errors.New("too many retries")
+	// ErrUnknownOutcome is matched by the errors of writes that may or may not
+	// have been applied, such as timeouts. Reading the key tells the outcome.
+	ErrUnknownOutcome = errors.New("unknown outcome")
+)
+
+// Entry is a key, its version and value.
+type Entry struct {
+	Key string `json:"key"`
+	Ver uint64 `json:"ver"`
+	Val string `json:"val"`
+}
+
+// VersionMismatchError is returned when a write was rejected because the
+// key's version didn't match the expected one.
+type VersionMismatchError struct {
+	Key      string
+	Expected uint64
+	Current  uint64
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("version mismatch on %s (%d != %d)", e.Key, e.Expected, e.Current)
+}
+
+func (e *VersionMismatchError) Is(target error) bool {
+	return target == ErrVersionMismatch
+}
+
+// StatusError is returned for unexpected responses. Code is the stable error
+// code of the response, e.g. timeout or system_busy.
+type StatusError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// retryAfter is the Retry-After header of retryable responses
+	retryAfter time.Duration
+	// unknownOutcome is set for write responses that don't tell whether the
+	// write was applied
+	unknownOutcome bool
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d (%s), %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (e *StatusError) Is(target error) bool {
+	return target == ErrUnknownOutcome && e.unknownOutcome
+}
+
+// Config is the configuration of a Client.
+type Config struct {
+	// Endpoints are the base URLs of the nodes, e.g. http://localhost:8001.
+	Endpoints []string
+	// Token is the bearer token sent with each request when set.
+	Token string
+	// HTTPClient is used to send requests, http.DefaultClient when nil.
+	HTTPClient *http.Client
+	// MaxRetries bounds the retries of a request, 10 when 0. Requests are
+	// retried until their context is done when it is negative.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the exponential backoff between retries,
+	// 50ms and 2s when 0.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Client is safe for concurrent use.
+type Client struct {
+	cfg Config
+	mu  sync.Mutex
+	// leader is the base URL of the last known leader
+	leader string
+	// next is the index of the endpoint tried when the leader is unknown
+	next int
+}
+
+// New returns a client of the nodes in cfg.Endpoints.
+func New(cfg Config) (*Client, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.New("no endpoints")
+	}
+	endpoints := make([]string, 0, len(cfg.Endpoints))
+	for _, e := range cfg.Endpoints {
+		if _, err := url.Parse(e); err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q, %w", e, err)
+		}
+		endpoints = append(endpoints, strings.TrimSuffix(e, "/"))
+	}
+	cfg.Endpoints = endpoints
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 10
+	}
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = 50 * time.Millisecond
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = 2 * time.Second
+	}
+	return &Client{cfg: cfg}, nil
+}
+
+// Get returns the entry of key, ErrNotFound when it doesn't exist.
+func (c *Client) Get(ctx context.Context, key string) (Entry, error) {
+	return c.do(ctx, "GET", key, nil, 0)
+}
+
+// Put sets the value of key when its current version is ver. A ver of 0 only
+// creates new keys, other versions never match a missing key. A
+// *VersionMismatchError is returned when the version doesn't match. An error
+// matching ErrUnknownOutcome is returned when the put may have been applied.
+func (c *Client) Put(ctx context.Context, key string, val string, ver uint64) (Entry, error) {
+	params := url.Values{"val": {val}, "ver": {strconv.FormatUint(ver, 10)}}
+	return c.do(ctx, "PUT", key, params, ver)
+}
+
+// Delete removes key when its current version is ver, a ver of 0 removes the
+// key unconditionally. The deleted entry is returned.
+func (c *Client) Delete(ctx context.Context, key string, ver uint64) (Entry, error) {
+	params := url.Values{}
+	if ver != 0 {
+		params.Set("ver", strconv.FormatUint(ver, 10))
+	}
+	return c.do(ctx, "DELETE", key, params, ver)
+}
+
+// Update performs a version checked read-modify-write of key. fn is called
+// with the current entry, exists is false when the key doesn't exist, and
+// returns the new value. fn is called again with the new current entry when
+// the key was changed concurrently, it must not have side effects. Update
+// stops when fn returns an error, and when the outcome of the put is unknown
+// as retrying it could apply fn twice.
+func (c *Client) Update(ctx context.Context, key string,
+	fn func(old Entry, exists bool) (string, error)) (Entry, error) {
+	for attempt := 0; ; attempt++ {
+		old, err := c.Get(ctx, key)
+		exists := err == nil
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return Entry{}, err
+		}
+		val, err := fn(old, exists)
+		if err != nil {
+			return Entry{}, err
+		}
+		entry, err := c.Put(ctx, key, val, old.Ver)
+		if !errors.Is(err, ErrVersionMismatch) {
+			return entry, err
+		}
+		if err := c.backoff(ctx, attempt, 0); err != nil {
+			return Entry{}, err
+		}
+	}
+}
+
+// do sends a request to the leader, or to the next endpoint when the leader is
+// unknown or unreachable, retrying unavailable nodes with backoff.
+func (c *Client) do(ctx context.Context, method string, key string,
+	params url.Values, ver uint64) (Entry, error) {
+	if !strings.HasPrefix(key, "/") {
+		key = "/" + key
+	}
+	for attempt := 0; ; attempt++ {
+		endpoint := c.endpoint()
+		entry, retry, err := c.send(ctx, endpoint, method, key, params, ver)
+		if !retry {
+			return entry, err
+		}
+		c.failed(endpoint)
+		var retryAfter time.Duration
+		var se *StatusError
+		if errors.As(err, &se) {
+			retryAfter = se.retryAfter
+		}
+		if err := c.backoff(ctx, attempt, retryAfter); err != nil {
+			return Entry{}, err
+		}
+	}
+}
+
+// send sends a single request and reports whether it can be retried.
+func (c *Client) send(ctx context.Context, endpoint string, method string, key string,
+	params url.Values, ver uint64) (Entry, bool, error) {
+	u := endpoint + (&url.URL{Path: key}).EscapedPath()
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	if len(c.cfg.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout := time.Until(deadline); timeout > 0 && timeout <= maxTimeout {
+			req.Header.Set(headerTimeout, timeout.String())
+		}
+	}
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Entry{}, false, ctx.Err()
+		}
+		// writes are only retried when they weren't sent
+		if method != "GET" && !isDialError(err) {
+			return Entry{}, false, fmt.Errorf("%w, %v", ErrUnknownOutcome, err)
+		}
+		return Entry{}, true, err
+	}
+	defer resp.Body.Close()
+	if leader := resp.Header.Get(headerLeader); len(leader) > 0 {
+		c.setLeader(leader)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Entry{}, true, err
+	}
+	switch resp.StatusCode {
+	case 200:
+		var entry Entry
+		if err := json.Unmarshal(body, &entry); err != nil {
+			return Entry{}, false, err
+		}
+		return entry, false, nil
+	case 404:
+		return Entry{}, false, ErrNotFound
+	case 409, 412:
+		current, _ := parseETag(resp.Header.Get("ETag"))
+		return Entry{}, false, &VersionMismatchError{Key: key, Expected: ver, Current: current}
+	case 401:
+		return Entry{}, false, ErrUnauthenticated
+	case 403:
+		return Entry{}, false, ErrPermissionDenied
+	}
+	se := &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	var apiErr struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &apiErr) == nil && len(apiErr.Code) > 0 {
+		se.Code, se.Message = apiErr.Code, apiErr.Message
+	}
+	switch resp.StatusCode {
+	case 429, 502, 503, 504:
+	default:
+		return Entry{}, false, se
+	}
+	// only writes rejected before being proposed can be retried, the others
+	// may still be applied and retrying them could apply them twice
+	if method != "GET" && resp.StatusCode != 429 && se.Code != codeNotLeader {
+		se.unknownOutcome = true
+		return Entry{}, false, se
+	}
+	if v, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		se.retryAfter = time.Duration(v) * time.Second
+	}
+	return Entry{}, true, se
+}
+
+// isDialError returns true when err means the request wasn't sent as no
+// connection could be made.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// endpoint returns the leader when known and the next endpoint otherwise.
+func (c *Client) endpoint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.leader) > 0 {
+		return c.leader
+	}
+	return c.cfg.Endpoints[c.next%len(c.cfg.Endpoints)]
+}
+
+func (c *Client) setLeader(leader string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leader = strings.TrimSuffix(leader, "/")
+}
+
+// failed forgets the leader when it failed and moves on to the next endpoint.
+func (c *Client) failed(endpoint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leader == endpoint {
+		c.leader = ""
+	}
+	if c.cfg.Endpoints[c.next%len(c.cfg.Endpoints)] == endpoint {
+		c.next++
+	}
+}
+
+// backoff waits before the retry following attempt, it waits at least
+// retryAfter when set.
+func (c *Client) backoff(ctx context.Context, attempt int, retryAfter time.Duration) error {
+	if c.cfg.MaxRetries > 0 && attempt >= c.cfg.MaxRetries {
+		return ErrTooManyRetries
+	}
+	d := c.cfg.MinBackoff << uint(attempt)
+	if d > c.cfg.MaxBackoff || d <= 0 {
+		d = c.cfg.MaxBackoff
+	}
+	// full jitter keeps retrying clients from moving in lockstep
+	d = time.Duration(rand.Int63n(int64(d)) + 1)
+	if d < retryAfter {
+		d = retryAfter
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseETag parses the quoted version in an ETag header.
+func parseETag(v string) (uint64, bool) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+	s, err := strconv.Unquote(v)
+	if err != nil {
+		return 0, false
+	}
+	ver, err := strconv.ParseUint(s, 10, 64)
+	return ver, err == nil
+}
@@ -0,0 +1,296 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode is a node serving a single key. Requests are answered by respond
+// when it returns a status other than 0.
+type fakeNode struct {
+	mu       sync.Mutex
+	ver      uint64
+	val      string
+	leader   string
+	requests []string
+	respond  func(r *http.Request, n int) (int, http.Header)
+	// code is the error code of the responses made by respond
+	code string
+}
+
+func (f *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method)
+	if len(f.leader) > 0 {
+		w.Header().Set(headerLeader, f.leader)
+	}
+	if f.respond != nil {
+		if status, header := f.respond(r, len(f.requests)); status != 0 {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			code := f.code
+			if len(code) == 0 {
+				code = "test"
+			}
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"code":%q,"message":"status %d"}`, code, status)
+			return
+		}
+	}
+	switch r.Method {
+	case "GET":
+		if f.ver == 0 {
+			w.WriteHeader(404)
+			return
+		}
+	case "PUT":
+		ver, _ := strconv.ParseUint(r.FormValue("ver"), 10, 64)
+		if ver != f.ver {
+			w.Header().Set("ETag", strconv.Quote(fmt.Sprint(f.ver)))
+			w.WriteHeader(409)
+			return
+		}
+		f.ver++
+		f.val = r.FormValue("val")
+	}
+	fmt.Fprintf(w, `{"key":%q,"ver":%d,"val":%q}`, r.URL.Path, f.ver, f.val)
+}
+
+func (f *fakeNode) methods() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+func newTestClient(t *testing.T, endpoints ...string) *Client {
+	c, err := New(Config{
+		Endpoints:  endpoints,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to create the client, %v", err)
+	}
+	return c
+}
+
+func TestLeaderHeader(t *testing.T) {
+	leader := &fakeNode{}
+	ls := httptest.NewServer(leader)
+	defer ls.Close()
+	follower := &fakeNode{leader: ls.URL}
+	fs := httptest.NewServer(follower)
+	defer fs.Close()
+	c := newTestClient(t, fs.URL)
+	ctx := context.Background()
+	if _, err := c.Put(ctx, "/a", "1", 0); err != nil {
+		t.Fatalf("put failed, %v", err)
+	}
+	// the follower served the first request, the leader it named the others
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get(ctx, "/a"); err != nil && !errors.Is(err, ErrNotFound) {
+			t.Fatalf("get failed, %v", err)
+		}
+	}
+	if n := len(follower.methods()); n != 1 {
+		t.Errorf("follower received %d requests, want 1", n)
+	}
+	if n := len(leader.methods()); n != 3 {
+		t.Errorf("leader received %d requests, want 3", n)
+	}
+	// an unreachable leader is forgotten, the configured endpoints are used
+	ls.Close()
+	follower.mu.Lock()
+	follower.leader = ""
+	follower.mu.Unlock()
+	if _, err := c.Get(ctx, "/a"); err != nil {
+		t.Fatalf("get failed after the leader failed, %v", err)
+	}
+	if n := len(follower.methods()); n != 2 {
+		t.Errorf("follower received %d requests, want 2", n)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	node := &fakeNode{ver: 1, val: "1"}
+	node.respond = func(r *http.Request, n int) (int, http.Header) {
+		if n == 1 {
+			return 503, http.Header{"Retry-After": {"1"}}
+		}
+		return 0, nil
+	}
+	s := httptest.NewServer(node)
+	defer s.Close()
+	c := newTestClient(t, s.URL)
+	start := time.Now()
+	entry, err := c.Get(context.Background(), "/a")
+	if err != nil || entry.Val != "1" {
+		t.Fatalf("get returned %+v, %v", entry, err)
+	}
+	// the backoff is at most 10ms, the retry waited for Retry-After
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("retried after %s, want at least 1s", d)
+	}
+}
+
+func TestTooManyRetries(t *testing.T) {
+	node := &fakeNode{}
+	node.respond = func(r *http.Request, n int) (int, http.Header) {
+		return 503, nil
+	}
+	s := httptest.NewServer(node)
+	defer s.Close()
+	c := newTestClient(t, s.URL)
+	c.cfg.MaxRetries = 3
+	if _, err := c.Get(context.Background(), "/a"); !errors.Is(err, ErrTooManyRetries) {
+		t.Fatalf("get returned %v, want ErrTooManyRetries", err)
+	}
+	if n := len(node.methods()); n != 4 {
+		t.Errorf("node received %d requests, want 4", n)
+	}
+}
+
+func TestUpdateRetriesConflicts(t *testing.T) {
+	node := &fakeNode{ver: 1, val: "1"}
+	node.respond = func(r *http.Request, n int) (int, http.Header) {
+		if r.Method == "PUT" && n == 2 {
+			// a concurrent write changed the key after it was read
+			node.ver, node.val = 2, "10"
+		}
+		return 0, nil
+	}
+	s := httptest.NewServer(node)
+	defer s.Close()
+	c := newTestClient(t, s.URL)
+	var calls []string
+	entry, err := c.Update(context.Background(), "/a", func(old Entry, exists bool) (string, error) {
+		calls = append(calls, old.Val)
+		n, _ := strconv.Atoi(old.Val)
+		return strconv.Itoa(n + 1), nil
+	})
+	if err != nil {
+		t.Fatalf("update failed, %v", err)
+	}
+	if entry.Val != "11" || entry.Ver != 3 {
+		t.Errorf("update returned %+v, want 11 at version 3", entry)
+	}
+	if len(calls) != 2 || calls[0] != "1" || calls[1] != "10" {
+		t.Errorf("fn called with %v, want [1 10]", calls)
+	}
+}
+
+func TestUnknownOutcomeNotRetried(t *testing.T) {
+	node := &fakeNode{ver: 1, val: "1"}
+	node.respond = func(r *http.Request, n int) (int, http.Header) {
+		if r.Method == "PUT" {
+			// the proposal timed out but was applied
+			node.ver, node.val = 2, r.FormValue("val")
+			return 504, http.Header{"Retry-After": {"1"}}
+		}
+		return 0, nil
+	}
+	s := httptest.NewServer(node)
+	defer s.Close()
+	c := newTestClient(t, s.URL)
+	calls := 0
+	_, err := c.Update(context.Background(), "/a", func(old Entry, exists bool) (string, error) {
+		calls++
+		return old.Val + "+", nil
+	})
+	if !errors.Is(err, ErrUnknownOutcome) {
+		t.Fatalf("update returned %v, want ErrUnknownOutcome", err)
+	}
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != 504 {
+		t.Errorf("update returned %v, want a 504 status error", err)
+	}
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+	if methods := node.methods(); len(methods) != 2 {
+		t.Errorf("node received %v, want a single GET and PUT", methods)
+	}
+}
+
+func TestWriteRetries(t *testing.T) {
+	tests := []struct {
+		status  int
+		code    string
+		retried bool
+	}{
+		{429, "overloaded", true},
+		{503, "not_leader", true},
+		{502, "test", false},
+		{503, "canceled", false},
+		{503, "unavailable", false},
+		{504, "timeout", false},
+	}
+	for _, tt := range tests {
+		node := &fakeNode{ver: 1, val: "1", code: tt.code}
+		node.respond = func(r *http.Request, n int) (int, http.Header) {
+			if n == 1 {
+				return tt.status, nil
+			}
+			return 0, nil
+		}
+		s := httptest.NewServer(node)
+		c := newTestClient(t, s.URL)
+		_, err := c.Put(context.Background(), "/a", "2", 1)
+		s.Close()
+		if tt.retried && err != nil {
+			t.Errorf("%d %s: put failed, %v", tt.status, tt.code, err)
+		}
+		if !tt.retried && !errors.Is(err, ErrUnknownOutcome) {
+			t.Errorf("%d %s: put returned %v, want ErrUnknownOutcome", tt.status, tt.code, err)
+		}
+		want := 1
+		if tt.retried {
+			want = 2
+		}
+		if n := len(node.methods()); n != want {
+			t.Errorf("%d %s: node received %d requests, want %d", tt.status, tt.code, n, want)
+		}
+	}
+}
+
+func TestReadTimeoutRetried(t *testing.T) {
+	node := &fakeNode{ver: 1, val: "1"}
+	node.respond = func(r *http.Request, n int) (int, http.Header) {
+		if n == 1 {
+			return 504, nil
+		}
+		return 0, nil
+	}
+	s := httptest.NewServer(node)
+	defer s.Close()
+	c := newTestClient(t, s.URL)
+	if _, err := c.Get(context.Background(), "/a"); err != nil {
+		t.Fatalf("get failed, %v", err)
+	}
+	if n := len(node.methods()); n != 2 {
+		t.Errorf("node received %d requests, want 2", n)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/lni/dragonboat/v4"
+)
+
+// Error codes are part of the API, clients can rely on them not to change.
+const (
+	ErrorCodeBadRequest         = "bad_request"
+	ErrorCodeNotFound           = "not_found"
+	ErrorCodeMethodNotAllowed   = "method_not_allowed"
+	ErrorCodeVersionMismatch    = "version_mismatch"
+	ErrorCodePreconditionFailed = "precondition_failed"
+	ErrorCodeUnauthenticated    = "unauthenticated"
+	ErrorCodePermissionDenied   = "permission_denied"
+	ErrorCodeMembershipChanged  = "membership_changed"
+	ErrorCodeOutOfRange         = "out_of_range"
+	ErrorCodeLocked             = "locked"
+	ErrorCodeLockLost           = "lock_lost"
+	ErrorCodeNotLeader          = "not_leader"
+	ErrorCodeClockSkew          = "clock_skew"
+	ErrorCodeLastAdmin          = "last_admin"
+	// the request was shed by the admission limiter
+	ErrorCodeOverloaded = "overloaded"
+	// the request may or may not have been applied when it timed out
+	ErrorCodeTimeout       = "timeout"
+	ErrorCodeCanceled      = "canceled"
+	ErrorCodeSystemBusy    = "system_busy"
+	ErrorCodeShardNotReady = "shard_not_ready"
+	ErrorCodeRejected      = "rejected"
+	ErrorCodeAborted       = "aborted"
+	ErrorCodeUnavailable   = "unavailable"
+	ErrorCodePayloadTooBig = "payload_too_big"
+	ErrorCodeInternal      = "internal"
+)
+
+// retryAfter is the Retry-After value in seconds sent with responses to
+// requests that can be retried.
+const retryAfter = 1
+
+// apiError is the body of all error responses. Version is the current version
+// of the key on version mismatches, Lock the lease of a lock held by another
+// owner.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Version uint64 `json:"current_version,omitempty"`
+	Lock    *Lock  `json:"lock,omitempty"`
+}
+
+// writeError writes a JSON error response.
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeAPIError(w, status, apiError{Code: code, Message: message})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, e apiError) {
+	b, _ := json.Marshal(e)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// writeOverloaded rejects a request shed by the limiter.
+func writeOverloaded(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeError(w, 429, ErrorCodeOverloaded, "Too many requests in flight")
+}
+
+// raftError maps an error returned by NodeHost to its status, error code and
+// whether the request can be retried.
+func raftError(err error) (int, string, bool) {
+	switch {
+	case errors.Is(err, dragonboat.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return 504, ErrorCodeTimeout, true
+	case errors.Is(err, dragonboat.ErrCanceled), errors.Is(err, context.Canceled):
+		return 503, ErrorCodeCanceled, true
+	case errors.Is(err, dragonboat.ErrSystemBusy):
+		return 429, ErrorCodeSystemBusy, true
+	case errors.Is(err, dragonboat.ErrShardNotReady),
+		errors.Is(err, dragonboat.ErrShardNotInitialized):
+		return 503, ErrorCodeShardNotReady, true
+	case errors.Is(err, dragonboat.ErrRejected):
+		return 503, ErrorCodeRejected, true
+	case errors.Is(err, dragonboat.ErrAborted):
+		return 503, ErrorCodeAborted, true
+	case errors.Is(err, dragonboat.ErrShardClosed),
+		errors.Is(err, dragonboat.ErrClosed),
+		errors.Is(err, dragonboat.ErrShardNotFound),
+		errors.Is(err, dragonboat.ErrReplicaRemoved):
+		return 503, ErrorCodeUnavailable, true
+	case errors.Is(err, dragonboat.ErrPayloadTooBig):
+		return 413, ErrorCodePayloadTooBig, false
+	case errors.Is(err, dragonboat.ErrTimeoutTooSmall),
+		errors.Is(err, dragonboat.ErrInvalidDeadline):
+		return 400, ErrorCodeBadRequest, false
+	}
+	return 500, ErrorCodeInternal, false
+}
+
+// writeRaftError writes the error response of a failed NodeHost request,
+// responses to retryable failures carry a Retry-After header.
+func writeRaftError(w http.ResponseWriter, err error) {
+	status, code, retry := raftError(err)
+	if retry {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	metrics.GetOrCreateCounter(fmt.Sprintf(`optimistic_write_lock_failed_requests_total{code="%s"}`, code)).Inc()
+	writeError(w, status, code, err.Error())
+}
@@ -0,0 +1,231 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultWaitTimeout is the timeout of waiting requests without a timeout
+	// header
+	defaultWaitTimeout = maxTimeout
+	// keepaliveInterval is the interval of the comments sent on idle event
+	// streams so proxies don't close them
+	keepaliveInterval = 15 * time.Second
+	// EventTypeCompacted ends an event stream that can't be resumed, the client
+	// has to list the keys again
+	EventTypeCompacted = "compacted"
+)
+
+// isWaitRequest returns whether a request blocks until a change, i.e. a long
+// poll or a lock acquisition waiting for the lock. Only the query string is
+// checked, parsing the form would consume the body of txn requests.
+func isWaitRequest(r *http.Request) bool {
+	return r.URL.Query().Get("wait") == "true"
+}
+
+// isWatchRequest returns whether a GET on /watch asks for an event stream
+// rather than the value of the key "/watch".
+func isWatchRequest(r *http.Request) bool {
+	if r.Method != "GET" || r.URL.Path != "/watch" {
+		return false
+	}
+	return r.URL.Query().Has("prefix") || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// watchPrincipal returns the principal of a long poll or event stream. The
+// request only holds a slot of the limiter while it is authenticated, not
+// while it waits for changes.
+func (h *handler) watchPrincipal(ctx context.Context, w http.ResponseWriter, r *http.Request) (Principal, bool) {
+	if !h.limiter.acquire() {
+		writeOverloaded(w)
+		return Principal{}, false
+	}
+	defer h.limiter.release()
+	res, err := h.read(ctx, r, WatchQuery{Token: token(r)})
+	if err != nil {
+		h.readError(w, err)
+		return Principal{}, false
+	}
+	return res.(Principal), true
+}
+
+// wait long polls a key. It responds once the key changed after the version in
+// the after parameter, with the new entry or 404 when the key was deleted, and
+// with 304 when the key didn't change before the request timed out. Without
+// after, it waits for the next change of the key applied by the local replica.
+func (h *handler) wait(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Path
+	if err := validateKey(key); err != nil {
+		writeError(w, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	var after uint64
+	if v := r.FormValue("after"); len(v) > 0 {
+		var err error
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeError(w, 400, ErrorCodeBadRequest, "After must be uint64")
+			return
+		}
+	} else {
+		after = h.hub.latest()
+	}
+	p, ok := h.watchPrincipal(ctx, w, r)
+	if !ok {
+		return
+	}
+	if !p.allowed(key, false) {
+		h.denied(w, ErrPermissionDenied)
+		return
+	}
+	watcher, err := h.hub.subscribeAfter(key, p, after)
+	if err == ErrCompacted {
+		// the changes since after are unknown, the current entry is returned
+		h.get(ctx, w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, 503, ErrorCodeUnavailable, err.Error())
+		return
+	}
+	defer h.hub.unsubscribe(watcher)
+	var last Event
+	for len(last.Type) == 0 {
+		select {
+		case e, ok := <-watcher.ch:
+			if !ok {
+				if watcher.err == ErrWatcherLagging {
+					h.get(ctx, w, r)
+				} else {
+					writeError(w, 503, ErrorCodeUnavailable, watcher.err.Error())
+				}
+				return
+			}
+			if e.Entry.Key == key {
+				last = e
+			}
+		case <-ctx.Done():
+			w.Header().Set("ETag", etag(after))
+			w.WriteHeader(304)
+			return
+		}
+	}
+	// replayed changes are all available at once, the latest one is returned
+	for more := true; more; {
+		select {
+		case e, ok := <-watcher.ch:
+			if ok && e.Entry.Key == key {
+				last = e
+			}
+			more = ok
+		default:
+			more = false
+		}
+	}
+	if last.Type == EventTypeDelete {
+		writeError(w, 404, ErrorCodeNotFound, "Not Found")
+		return
+	}
+	b, _ := json.Marshal(last.Entry)
+	w.Header().Set("ETag", etag(last.Entry.Ver))
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+// watch streams the changes of the keys starting with the prefix parameter as
+// server-sent events. Streams resume after the index in the after parameter or
+// the Last-Event-ID header when set, a compacted event is sent when the
+// changes to resume from are no longer available.
+func (h *handler) watch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, 500, ErrorCodeInternal, "Streaming not supported")
+		return
+	}
+	v := r.FormValue("after")
+	if len(v) == 0 {
+		v = r.Header.Get("Last-Event-ID")
+	}
+	var after uint64
+	if len(v) > 0 {
+		var err error
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeError(w, 400, ErrorCodeBadRequest, "After must be uint64")
+			return
+		}
+	}
+	p, ok := h.watchPrincipal(ctx, w, r)
+	if !ok {
+		return
+	}
+	prefix := r.FormValue("prefix")
+	var watcher *watcher
+	var err error
+	if len(v) > 0 {
+		watcher, err = h.hub.subscribeAfter(prefix, p, after)
+	} else {
+		watcher, err = h.hub.subscribe(prefix, p)
+	}
+	if err != nil && err != ErrCompacted {
+		writeError(w, 503, ErrorCodeUnavailable, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	if err == ErrCompacted {
+		writeEvent(w, EventTypeCompacted, 0, apiError{Code: EventTypeCompacted, Message: err.Error()})
+		return
+	}
+	defer h.hub.unsubscribe(watcher)
+	flusher.Flush()
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-watcher.ch:
+			if !ok {
+				if watcher.err == ErrWatcherLagging {
+					writeEvent(w, EventTypeCompacted, 0,
+						apiError{Code: EventTypeCompacted, Message: watcher.err.Error()})
+				}
+				return
+			}
+			writeEvent(w, e.Type, e.Index, e)
+		case <-keepalive.C:
+			w.Write([]byte(": keepalive\n\n"))
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes a server-sent event with the JSON encoded v as its data,
+// the id is omitted when it is 0.
+func writeEvent(w http.ResponseWriter, event string, id uint64, v interface{}) {
+	b, _ := json.Marshal(v)
+	if id != 0 {
+		fmt.Fprintf(w, "id: %d\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+}
@@ -0,0 +1,79 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWaitWithoutAfter(t *testing.T) {
+	n, url := startTestNode(t)
+	client := &http.Client{Timeout: 5 * time.Second}
+	do := func(method, path string, timeout time.Duration) (int, Entry) {
+		req, err := http.NewRequest(method, url+path, nil)
+		if err != nil {
+			t.Errorf("failed to create the request, %v", err)
+			return 0, Entry{}
+		}
+		req.Header.Set(headerTimeout, timeout.String())
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("%s %s failed, %v", method, path, err)
+			return 0, Entry{}
+		}
+		defer resp.Body.Close()
+		var entry Entry
+		json.NewDecoder(resp.Body).Decode(&entry)
+		return resp.StatusCode, entry
+	}
+	code, put := do("PUT", "/config?val=v1", time.Second)
+	if code != 200 {
+		t.Fatalf("put returned %d", code)
+	}
+	// the existing version isn't returned right away
+	start := time.Now()
+	if code, _ := do("GET", "/config?wait=true", 300*time.Millisecond); code != 304 {
+		t.Fatalf("wait returned %d, want 304", code)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("wait returned after %s", d)
+	}
+	type result struct {
+		code  int
+		entry Entry
+	}
+	ch := make(chan result, 1)
+	go func() {
+		code, entry := do("GET", "/config?wait=true", 3*time.Second)
+		ch <- result{code, entry}
+	}()
+	for deadline := time.Now().Add(time.Second); watchers(n.hub) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the long poll didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code, _ := do("PUT", fmt.Sprintf("/config?val=v2&ver=%d", put.Ver), time.Second); code != 200 {
+		t.Fatalf("put returned %d", code)
+	}
+	res := <-ch
+	if res.code != 200 || res.entry.Val != "v2" {
+		t.Errorf("wait returned %d %+v, want the second version", res.code, res.entry)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	ForwardModeNone     = ""
+	ForwardModeProxy    = "proxy"
+	ForwardModeRedirect = "redirect"
+)
+
+const (
+	headerLeader    = "X-Raft-Leader"
+	headerForwarded = "X-Raft-Forwarded"
+)
+
+// localPaths are always served by the node receiving the request as they
+// report on that node.
+var localPaths = map[string]bool{
+	"/metrics": true,
+	"/healthz": true,
+	"/readyz":  true,
+	"/status":  true,
+	// events are streamed from the local replica
+	"/watch": true,
+	// snapshots are taken and exported by the local replica
+	"/admin/snapshots": true,
+}
+
+// httpURL returns the base URL clients use to reach the HTTP listen address
+// addr. Listen addresses without a host are assumed to be local.
+func httpURL(addr string, secure bool) string {
+	scheme := "http://"
+	if secure {
+		scheme = "https://"
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return scheme + addr
+	}
+	if len(host) == 0 {
+		host = "localhost"
+	}
+	return scheme + net.JoinHostPort(host, port)
+}
+
+// forwarder sends requests received by a follower to the current leader of
+// the shard, either by proxying them or by redirecting the client.
+type forwarder struct {
+	mode string
+	// peers maps replica IDs to the base URLs of their HTTP servers
+	peers map[uint64]string
+	// transport is used by the proxies, http.DefaultTransport when nil
+	transport http.RoundTripper
+	// secret is the value of the forwarded header set by the proxies, it is
+	// shared by the nodes so clients can't mark their own requests as
+	// forwarded
+	secret  string
+	mu      sync.Mutex
+	proxies map[uint64]*httputil.ReverseProxy
+}
+
+// newForwarder returns a forwarder, a random secret is used when secret is
+// empty.
+func newForwarder(mode string, peers map[uint64]string, transport http.RoundTripper,
+	secret string) *forwarder {
+	if len(secret) == 0 {
+		secret = randomSecret()
+	}
+	return &forwarder{
+		mode:      mode,
+		peers:     peers,
+		transport: transport,
+		secret:    secret,
+		proxies:   map[uint64]*httputil.ReverseProxy{},
+	}
+}
+
+func randomSecret() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// forwarded returns true when r was proxied by another node, the header is
+// removed from requests of clients.
+func (f *forwarder) forwarded(r *http.Request) bool {
+	v := r.Header.Get(headerForwarded)
+	if len(v) == 0 {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(v), []byte(f.secret)) == 1 {
+		return true
+	}
+	r.Header.Del(headerForwarded)
+	return false
+}
+
+// leader returns the replica ID and base URL of the current leader when both
+// are known.
+func (f *forwarder) leader(h *handler) (uint64, string, bool) {
+	leaderID, _, valid, err := h.nh.GetLeaderID(h.shardID)
+	if err != nil || !valid {
+		return 0, "", false
+	}
+	u, ok := f.peers[leaderID]
+	return leaderID, u, ok
+}
+
+// forward sets the leader header and, when the local replica is not the
+// leader, hands the request over to the leader. It returns false when the
+// request should be served locally. Requests already proxied by another node
+// are always served locally so replicas with different views of the leader can't bounce
+// a request between them.
+func (f *forwarder) forward(h *handler, w http.ResponseWriter, r *http.Request) bool {
+	leaderID, leaderURL, ok := f.leader(h)
+	if !ok {
+		return false
+	}
+	local := f.forwarded(r) || leaderID == h.replicaID ||
+		localPaths[strings.TrimPrefix(r.URL.Path, h.prefix)]
+	if !local && f.mode == ForwardModeProxy {
+		// the leader sets the leader header on the proxied response
+		r.Header.Set(headerForwarded, f.secret)
+		f.proxy(leaderID, leaderURL).ServeHTTP(w, r)
+		return true
+	}
+	w.Header().Set(headerLeader, leaderURL)
+	if !local && f.mode == ForwardModeRedirect {
+		// 307 makes clients repeat the request with the same method and body
+		http.Redirect(w, r, leaderURL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return true
+	}
+	return false
+}
+
+func (f *forwarder) proxy(replicaID uint64, target string) *httputil.ReverseProxy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.proxies[replicaID]
+	if !ok {
+		u, err := url.Parse(target)
+		if err != nil {
+			panic(err)
+		}
+		p = httputil.NewSingleHostReverseProxy(u)
+		p.Transport = f.transport
+		f.proxies[replicaID] = p
+	}
+	return p
+}
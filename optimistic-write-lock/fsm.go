@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"strings"
+	"sync"
 
 	dbsm "github.com/lni/dragonboat/v4/statemachine"
 )
@@ -13,88 +16,601 @@ const (
 	ResultCodeFailure = iota
 	ResultCodeSuccess
 	ResultCodeVersionMismatch
+	ResultCodeNotFound
+	ResultCodeUnauthenticated
+	ResultCodePermissionDenied
+	ResultCodeOutOfRange
+	ResultCodeLocked
+	ResultCodeLockLost
+	ResultCodeClockSkew
+	ResultCodeLastAdmin
 )
 
+const (
+	CommandTypePut    = ""
+	CommandTypeDelete = "delete"
+	CommandTypeTxn    = "txn"
+	CommandTypeRevert = "revert"
+	CommandTypePatch  = "patch"
+	// lock commands, the lock name is the key, the owner the value and the
+	// fencing token the version of the command
+	CommandTypeLock   = "lock"
+	CommandTypeRenew  = "renew"
+	CommandTypeUnlock = "unlock"
+	// ACL commands, the principal name is the key of a delete command
+	CommandTypeSetPrincipal    = "set-principal"
+	CommandTypeDeletePrincipal = "delete-principal"
+	// CommandTypeCreateNamespace adds the namespace named by the key to the
+	// catalog of the default shard
+	CommandTypeCreateNamespace = "create-namespace"
+)
+
+const (
+	OpTypePut    = "put"
+	OpTypeDelete = "delete"
+	OpTypeGet    = "get"
+)
+
+const (
+	CompareTargetVer = "ver"
+	CompareTargetVal = "val"
+)
+
+const (
+	maxListLimit = 1000
+)
+
+// Query, ListQuery and Command carry the SHA-256 hash of the bearer token of
+// the request, access is checked by the state machine against the replicated
+// ACL table. A Query with a non-zero Ver returns that version of the key.
 type Query struct {
-	Key string
+	Key   string
+	Ver   uint64
+	Token string
+}
+
+// ListQuery lists up to Limit entries with keys starting with Prefix in key
+// order, starting after the key After.
+type ListQuery struct {
+	Prefix string
+	After  string
+	Limit  int
+	Token  string
 }
 
+// ListResult holds a page of listed entries. Next is the After value for the
+// following page, it is empty when there are no more entries.
+type ListResult struct {
+	Entries []Entry `json:"entries"`
+	Next    string  `json:"next,omitempty"`
+}
+
+// AppliedIndexQuery returns the index of the last entry applied by the
+// replica since it was started.
+type AppliedIndexQuery struct{}
+
 type Entry struct {
 	Key string `json:"key"`
 	Ver uint64 `json:"ver"`
 	Val string `json:"val"`
 }
 
-func NewLinearizableFSM() dbsm.CreateConcurrentStateMachineFunc {
+// Command is the proposal payload. A command without a type is a plain
+// version checked put of the embedded Entry. A delete command removes the key
+// when its version matches, version 0 deletes the key unconditionally. A
+// revert command is a version checked put of the value of version Revert. A
+// patch command applies Patch to the current value of the key. MustExist makes
+// a put, revert or patch fail with a version mismatch when the key doesn't
+// exist, version 0 then matches any version of the key. TTL is the lease
+// duration of lock commands in nanoseconds.
+// Time is the proposal time in Unix nanoseconds, it drives the expiry of the
+// history.
+type Command struct {
+	Type string `json:"type,omitempty"`
+	Entry
+	Txn       *Txn   `json:"txn,omitempty"`
+	Revert    uint64 `json:"revert,omitempty"`
+	Patch     *Patch `json:"patch,omitempty"`
+	MustExist bool   `json:"must_exist,omitempty"`
+	TTL       int64  `json:"ttl,omitempty"`
+	Token     string `json:"token,omitempty"`
+	Time      int64  `json:"time,omitempty"`
+}
+
+// Compare is a single condition of a transaction. Target selects whether the
+// key's version or value is compared, Result is one of =, !=, < and >. A
+// missing key has version 0 and an empty value.
+type Compare struct {
+	Key    string `json:"key"`
+	Target string `json:"target"`
+	Result string `json:"result"`
+	Ver    uint64 `json:"ver,omitempty"`
+	Val    string `json:"val,omitempty"`
+}
+
+type Op struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	Val  string `json:"val,omitempty"`
+}
+
+// Txn is applied atomically. When all Compare conditions hold the Then ops are
+// executed, otherwise the Else ops are executed.
+type Txn struct {
+	Compare []Compare `json:"compare"`
+	Then    []Op      `json:"then"`
+	Else    []Op      `json:"else"`
+}
+
+// TxnResult holds the outcome of each executed op in order. Put ops return the
+// new entry, get and delete ops return the entry as it was found.
+type TxnResult struct {
+	Succeeded bool    `json:"succeeded"`
+	Results   []Entry `json:"results"`
+}
+
+// NewLinearizableFSM returns the state machine factory, the changes applied
+// by the state machine are published to hub and its applied index to index.
+func NewLinearizableFSM(hub *watchHub, index *appliedIndex,
+	history historyOptions, owner *Principal) dbsm.CreateConcurrentStateMachineFunc {
 	return dbsm.CreateConcurrentStateMachineFunc(func(shardID, replicaID uint64) dbsm.IConcurrentStateMachine {
-		return &linearizableFSM{
-			shardID:   shardID,
-			replicaID: replicaID,
-			data:      map[string]interface{}{},
-		}
+		return newLinearizableFSM(shardID, replicaID, newMemoryStore(), hub, index, history, owner)
 	})
 }
 
+func newLinearizableFSM(shardID, replicaID uint64, s store, hub *watchHub,
+	index *appliedIndex, history historyOptions, owner *Principal) *linearizableFSM {
+	fsm := &linearizableFSM{
+		shardID:     shardID,
+		replicaID:   replicaID,
+		store:       s,
+		principals:  map[string]Principal{},
+		owner:       owner,
+		hub:         hub,
+		index:       index,
+		historyOpts: history,
+	}
+	if owner != nil {
+		fsm.principals[owner.TokenHash] = *owner
+	}
+	return fsm
+}
+
 type linearizableFSM struct {
 	shardID   uint64
 	replicaID uint64
-	data      map[string]interface{}
+	// mu makes the keys touched by a single entry visible to Lookup at once
+	mu    sync.RWMutex
+	store store
+	// principals indexes the ACL table by token hash
+	principals map[string]Principal
+	// owner is the admin of a namespace shard that created the namespace, it
+	// is an implicit principal of the ACL table
+	owner   *Principal
+	applied uint64
+	index   *appliedIndex
+	hub     *watchHub
+	// events holds the changes made by the entries being applied
+	events []Event
+	// historyOpts bounds the prior versions of each key kept by the store
+	historyOpts historyOptions
+	// now is the latest proposal time seen
+	now int64
+	// lockClock is the latest proposal time of the lock commands
+	lockClock int64
 }
 
 func (fsm *linearizableFSM) Update(entries []dbsm.Entry) ([]dbsm.Entry, error) {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+	fsm.apply(entries)
+	fsm.publish()
+	return entries, nil
+}
+
+// apply applies the commands of entries and sets their results.
+func (fsm *linearizableFSM) apply(entries []dbsm.Entry) {
+	var ok bool
+	fsm.events = fsm.events[:0]
 	for i, ent := range entries {
-		var entry Entry
-		if err := json.Unmarshal(ent.Cmd, &entry); err != nil {
-			return entries, fmt.Errorf("Invalid entry %#v, %w", ent, err)
-		}
-		if v, ok := fsm.data[entry.Key]; ok {
-			// Reject entries with mismatched versions
-			if v.(Entry).Ver != entry.Ver {
-				data, _ := json.Marshal(v)
-				entries[i].Result = dbsm.Result{
-					Value: ResultCodeVersionMismatch,
-					Data:  data,
-				}
-				continue
+		start := len(fsm.events)
+		fsm.applied = ent.Index
+		var cmd Command
+		if err := json.Unmarshal(ent.Cmd, &cmd); err != nil {
+			// a malformed entry is committed on all replicas, it is rejected
+			// rather than failing them all
+			entries[i].Result = rejected(fmt.Errorf("Invalid entry, %w", err))
+			continue
+		}
+		if err := cmd.validate(); err != nil {
+			entries[i].Result = rejected(err)
+			continue
+		}
+		fsm.tick(cmd.Time)
+		fsm.expire()
+		switch cmd.Type {
+		case CommandTypePut:
+			if entries[i].Result, ok = fsm.check(fsm.authorize(cmd.Token, true, cmd.Key)); ok {
+				entries[i].Result = fsm.put(cmd.Entry, cmd.MustExist, ent.Index)
+			}
+		case CommandTypeDelete:
+			if entries[i].Result, ok = fsm.check(fsm.authorize(cmd.Token, true, cmd.Key)); ok {
+				entries[i].Result = fsm.delete(cmd.Entry)
+			}
+		case CommandTypeRevert:
+			if entries[i].Result, ok = fsm.check(fsm.authorize(cmd.Token, true, cmd.Key)); ok {
+				entries[i].Result = fsm.revert(cmd, ent.Index)
+			}
+		case CommandTypePatch:
+			if entries[i].Result, ok = fsm.check(fsm.authorize(cmd.Token, true, cmd.Key)); ok {
+				entries[i].Result = fsm.patch(cmd, ent.Index)
+			}
+		case CommandTypeLock:
+			if entries[i].Result, ok = fsm.check(fsm.authorize(cmd.Token, true, cmd.Key)); ok {
+				entries[i].Result = fsm.acquire(cmd, ent.Index)
+			}
+		case CommandTypeRenew:
+			if entries[i].Result, ok = fsm.check(fsm.authorize(cmd.Token, true, cmd.Key)); ok {
+				entries[i].Result = fsm.renew(cmd, ent.Index)
+			}
+		case CommandTypeUnlock:
+			if entries[i].Result, ok = fsm.check(fsm.authorize(cmd.Token, true, cmd.Key)); ok {
+				entries[i].Result = fsm.release(cmd)
+			}
+		case CommandTypeTxn:
+			if entries[i].Result, ok = fsm.check(fsm.authorizeTxn(cmd.Token, cmd.Txn)); ok {
+				entries[i].Result = fsm.txn(cmd.Txn, ent.Index)
 			}
+		case CommandTypeSetPrincipal:
+			code, data := fsm.setPrincipal(cmd, ent.Index)
+			entries[i].Result = dbsm.Result{Value: code, Data: data}
+		case CommandTypeDeletePrincipal:
+			code, data := fsm.deletePrincipal(cmd)
+			entries[i].Result = dbsm.Result{Value: code, Data: data}
+		case CommandTypeCreateNamespace:
+			code, data := fsm.createNamespace(cmd, ent.Index)
+			entries[i].Result = dbsm.Result{Value: code, Data: data}
 		}
-		entry.Ver = ent.Index
-		fsm.data[entry.Key] = entry
-		b, _ := json.Marshal(entry)
-		entries[i].Result = dbsm.Result{
-			Value: ResultCodeSuccess,
-			Data:  b,
+		for j := start; j < len(fsm.events); j++ {
+			fsm.events[j].Index = ent.Index
 		}
 	}
+}
 
-	return entries, nil
+// publish sends the changes made by the applied entries to the watchers and
+// advances the applied index.
+func (fsm *linearizableFSM) publish() {
+	if fsm.hub != nil && len(fsm.events) > 0 {
+		fsm.hub.publish(fsm.events)
+	}
+	fsm.index.advance(fsm.applied)
 }
 
-func (fsm *linearizableFSM) Lookup(e interface{}) (val interface{}, err error) {
-	query, ok := e.(Query)
+// put sets entry when the version of the key matches the version of entry, a
+// missing key matches any version unless mustExist is set.
+func (fsm *linearizableFSM) put(entry Entry, mustExist bool, index uint64) dbsm.Result {
+	v, ok := fsm.store.get(entry.Key)
+	if !ok {
+		v = Entry{Key: entry.Key}
+	}
+	// Reject entries with mismatched versions
+	if (mustExist && !ok) || (ok && v.Ver != entry.Ver && !(mustExist && entry.Ver == 0)) {
+		data, _ := json.Marshal(v)
+		return dbsm.Result{
+			Value: ResultCodeVersionMismatch,
+			Data:  data,
+		}
+	}
+	entry.Ver = index
+	fsm.set(entry)
+	b, _ := json.Marshal(entry)
+	return dbsm.Result{
+		Value: ResultCodeSuccess,
+		Data:  b,
+	}
+}
+
+func (fsm *linearizableFSM) delete(entry Entry) dbsm.Result {
+	v, ok := fsm.store.get(entry.Key)
 	if !ok {
+		return dbsm.Result{Value: ResultCodeNotFound}
+	}
+	data, _ := json.Marshal(v)
+	if entry.Ver != 0 && v.Ver != entry.Ver {
+		return dbsm.Result{
+			Value: ResultCodeVersionMismatch,
+			Data:  data,
+		}
+	}
+	fsm.remove(entry.Key)
+	return dbsm.Result{
+		Value: ResultCodeSuccess,
+		Data:  data,
+	}
+}
+
+// rejected returns the result of an entry that failed validation, the reason
+// is returned as the result data.
+func rejected(err error) dbsm.Result {
+	return dbsm.Result{Value: ResultCodeFailure, Data: []byte(err.Error())}
+}
+
+// check converts an authorization error into the result of the rejected
+// entry, it returns true when the entry can be applied.
+func (fsm *linearizableFSM) check(err error) (dbsm.Result, bool) {
+	if err == nil {
+		return dbsm.Result{}, true
+	}
+	code := uint64(ResultCodePermissionDenied)
+	if err == ErrUnauthenticated {
+		code = ResultCodeUnauthenticated
+	}
+	return dbsm.Result{Value: code, Data: []byte(err.Error())}, false
+}
+
+func (fsm *linearizableFSM) txn(txn *Txn, index uint64) dbsm.Result {
+	res := TxnResult{Succeeded: true}
+	for _, c := range txn.Compare {
+		if current, _ := fsm.store.get(c.Key); !c.holds(current) {
+			res.Succeeded = false
+			break
+		}
+	}
+	ops := txn.Then
+	if !res.Succeeded {
+		ops = txn.Else
+	}
+	res.Results = make([]Entry, 0, len(ops))
+	for _, op := range ops {
+		entry, ok := fsm.store.get(op.Key)
+		if !ok {
+			entry = Entry{Key: op.Key}
+		}
+		switch op.Type {
+		case OpTypePut:
+			entry = Entry{Key: op.Key, Ver: index, Val: op.Val}
+			fsm.set(entry)
+		case OpTypeDelete:
+			fsm.remove(op.Key)
+		}
+		res.Results = append(res.Results, entry)
+	}
+	b, _ := json.Marshal(res)
+	return dbsm.Result{
+		Value: ResultCodeSuccess,
+		Data:  b,
+	}
+}
+
+// set stores entry, the replaced entry is added to the history.
+func (fsm *linearizableFSM) set(entry Entry) {
+	if old, ok := fsm.store.get(entry.Key); ok {
+		fsm.archive(old)
+	}
+	fsm.store.set(entry)
+	fsm.events = append(fsm.events, Event{Type: EventTypePut, Entry: entry})
+}
+
+// remove deletes key, the removed entry is added to the history.
+func (fsm *linearizableFSM) remove(key string) {
+	entry, ok := fsm.store.get(key)
+	if !ok {
+		return
+	}
+	fsm.store.remove(key)
+	fsm.archive(entry)
+	fsm.events = append(fsm.events, Event{Type: EventTypeDelete, Entry: entry})
+}
+
+// list returns the entries matching query, keys the principal is not allowed
+// to read are skipped.
+func (fsm *linearizableFSM) list(query ListQuery) (ListResult, error) {
+	p, err := fsm.principal(query.Token)
+	if err != nil {
+		return ListResult{}, err
+	}
+	if query.Limit <= 0 || query.Limit > maxListLimit {
+		query.Limit = maxListLimit
+	}
+	start := query.Prefix
+	if query.After > start {
+		start = query.After
+	}
+	res := ListResult{Entries: []Entry{}}
+	fsm.store.scan(start, func(entry Entry) bool {
+		if entry.Key == query.After {
+			return true
+		}
+		if !strings.HasPrefix(entry.Key, query.Prefix) {
+			return false
+		}
+		if !p.allowed(entry.Key, false) {
+			return true
+		}
+		if len(res.Entries) == query.Limit {
+			res.Next = res.Entries[len(res.Entries)-1].Key
+			return false
+		}
+		res.Entries = append(res.Entries, entry)
+		return true
+	})
+	return res, nil
+}
+
+func (txn *Txn) validate() error {
+	if txn == nil {
+		return fmt.Errorf("Missing txn")
+	}
+	if n := len(txn.Compare) + len(txn.Then) + len(txn.Else); n > maxTxnOps {
+		return fmt.Errorf("Txn has %d comparisons and ops, at most %d are allowed", n, maxTxnOps)
+	}
+	for _, c := range txn.Compare {
+		if err := validateKey(c.Key); err != nil {
+			return err
+		}
+		if c.Target != CompareTargetVer && c.Target != CompareTargetVal {
+			return fmt.Errorf("Invalid compare target %q", c.Target)
+		}
+		switch c.Result {
+		case "=", "!=", "<", ">":
+		default:
+			return fmt.Errorf("Invalid compare result %q", c.Result)
+		}
+	}
+	for _, ops := range [][]Op{txn.Then, txn.Else} {
+		for _, op := range ops {
+			switch op.Type {
+			case OpTypePut, OpTypeDelete, OpTypeGet:
+			default:
+				return fmt.Errorf("Invalid op type %q", op.Type)
+			}
+			if err := validateKey(op.Key); err != nil {
+				return err
+			}
+			if err := validateValue(op.Val); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c Compare) holds(entry Entry) bool {
+	var cmp int
+	if c.Target == CompareTargetVer {
+		if entry.Ver < c.Ver {
+			cmp = -1
+		} else if entry.Ver > c.Ver {
+			cmp = 1
+		}
+	} else {
+		cmp = bytes.Compare([]byte(entry.Val), []byte(c.Val))
+	}
+	switch c.Result {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case ">":
+		return cmp > 0
+	}
+	return false
+}
+
+func (fsm *linearizableFSM) Lookup(e interface{}) (val interface{}, err error) {
+	fsm.mu.RLock()
+	defer fsm.mu.RUnlock()
+	return fsm.lookup(e)
+}
+
+func (fsm *linearizableFSM) lookup(e interface{}) (val interface{}, err error) {
+	switch query := e.(type) {
+	case Query:
+		if err := fsm.authorize(query.Token, false, query.Key); err != nil {
+			return nil, err
+		}
+		if query.Ver != 0 {
+			if entry, ok := fsm.version(query.Key, query.Ver); ok {
+				val = entry
+			}
+		} else if entry, ok := fsm.store.get(query.Key); ok {
+			val = entry
+		}
+	case HistoryQuery:
+		return fsm.keyHistory(query)
+	case LockQuery:
+		return fsm.lock(query)
+	case ListQuery:
+		return fsm.list(query)
+	case ACLQuery:
+		return fsm.listPrincipals(query.Token)
+	case CatalogQuery:
+		return fsm.catalog(), nil
+	case AdminQuery:
+		return nil, fsm.requireAdmin(query.Token)
+	case AppliedIndexQuery:
+		val = fsm.applied
+	case WatchQuery:
+		return fsm.principal(query.Token)
+	default:
 		return nil, fmt.Errorf("Invalid query %#v", e)
 	}
-	val, _ = fsm.data[query.Key]
 
 	return
 }
 
+// snapshotMeta is the last part of the snapshot.
+type snapshotMeta struct {
+	// Applied is the index of the last entry included in the snapshot
+	Applied   uint64 `json:"applied"`
+	LockClock int64  `json:"lock_clock"`
+}
+
+// PrepareSnapshot encodes the entries followed by the history and the
+// snapshot metadata, older snapshots only hold the entries or the entries and
+// the history.
 func (fsm *linearizableFSM) PrepareSnapshot() (ctx interface{}, err error) {
-	return
+	fsm.mu.RLock()
+	defer fsm.mu.RUnlock()
+	var buf bytes.Buffer
+	if err = writeSnapshot(&buf, fsm.store, fsm.now, fsm.meta()); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
 }
 
 func (fsm *linearizableFSM) SaveSnapshot(ctx interface{}, w io.Writer, sfc dbsm.ISnapshotFileCollection, stopc <-chan struct{}) (err error) {
-	b, err := json.Marshal(fsm.data)
-	if err == nil {
-		_, err = io.Copy(w, bytes.NewReader(b))
-	}
+	_, err = io.Copy(w, bytes.NewReader(ctx.([]byte)))
 
 	return
 }
 
 func (fsm *linearizableFSM) RecoverFromSnapshot(r io.Reader, sfc []dbsm.SnapshotFile, stopc <-chan struct{}) (err error) {
-	return json.NewDecoder(r).Decode(fsm.data)
+	s := newMemoryStore()
+	now, meta, err := readSnapshot(r, s)
+	if err != nil {
+		return
+	}
+	fsm.mu.Lock()
+	fsm.recover(s, now, meta)
+	fsm.mu.Unlock()
+	fsm.recovered(meta.Applied)
+
+	return
+}
+
+// meta returns the snapshot metadata of the current state.
+func (fsm *linearizableFSM) meta() snapshotMeta {
+	return snapshotMeta{Applied: fsm.applied, LockClock: fsm.lockClock}
+}
+
+// recover replaces the state with the store s recovered from a snapshot.
+func (fsm *linearizableFSM) recover(s store, now int64, meta snapshotMeta) {
+	fsm.store = s
+	fsm.now = now
+	if meta.Applied != 0 {
+		fsm.applied = meta.Applied
+	}
+	fsm.lockClock = meta.LockClock
+	fsm.rebuildExpiry()
+	fsm.rebuildACL()
+}
+
+// recovered resets the applied index and the event log of the watchers after
+// the state was replaced by the one as of applied.
+func (fsm *linearizableFSM) recovered(applied uint64) {
+	fsm.index.advance(applied)
+	if fsm.hub != nil {
+		since := applied
+		if since == 0 {
+			// older snapshots don't record their index, no event can be replayed
+			since = math.MaxUint64
+		}
+		fsm.hub.reset(since)
+	}
 }
 
 func (fsm *linearizableFSM) Close() (err error) {
@@ -0,0 +1,418 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dbsm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// testFSM drives a state machine directly, without a NodeHost. Each proposed
+// command is applied as the next entry of the log.
+type testFSM struct {
+	t       *testing.T
+	fsm     *linearizableFSM
+	index   uint64
+	update  func([]dbsm.Entry) ([]dbsm.Entry, error)
+	lookup  func(interface{}) (interface{}, error)
+	save    func(io.Writer) error
+	recover func(io.Reader) error
+}
+
+func newMemoryTestFSM(t *testing.T, history historyOptions) *testFSM {
+	fsm := newLinearizableFSM(1, 1, newMemoryStore(), nil, newAppliedIndex(), history, nil)
+	return &testFSM{
+		t:      t,
+		fsm:    fsm,
+		update: fsm.Update,
+		lookup: fsm.Lookup,
+		save: func(w io.Writer) error {
+			ctx, err := fsm.PrepareSnapshot()
+			if err != nil {
+				return err
+			}
+			return fsm.SaveSnapshot(ctx, w, nil, nil)
+		},
+		recover: func(r io.Reader) error {
+			return fsm.RecoverFromSnapshot(r, nil, nil)
+		},
+	}
+}
+
+func newDiskTestFSM(t *testing.T, history historyOptions) *testFSM {
+	fsm := NewOnDiskFSM(t.TempDir(), nil, newAppliedIndex(), history, nil)(1, 1).(*onDiskFSM)
+	applied, err := fsm.Open(nil)
+	if err != nil {
+		t.Fatalf("failed to open the state machine, %v", err)
+	}
+	t.Cleanup(func() { fsm.Close() })
+	return &testFSM{
+		t:      t,
+		fsm:    fsm.linearizableFSM,
+		index:  applied,
+		update: fsm.Update,
+		lookup: fsm.Lookup,
+		save: func(w io.Writer) error {
+			ctx, err := fsm.PrepareSnapshot()
+			if err != nil {
+				return err
+			}
+			return fsm.SaveSnapshot(ctx, w, nil)
+		},
+		recover: func(r io.Reader) error {
+			return fsm.RecoverFromSnapshot(r, nil)
+		},
+	}
+}
+
+// forEachStore runs f against the in memory and the on disk state machines.
+func forEachStore(t *testing.T, history historyOptions, f func(t *testing.T, sm *testFSM)) {
+	t.Run(StorageMemory, func(t *testing.T) { f(t, newMemoryTestFSM(t, history)) })
+	t.Run(StorageDisk, func(t *testing.T) { f(t, newDiskTestFSM(t, history)) })
+}
+
+// proposeRaw applies data as the command of the next entry.
+func (sm *testFSM) proposeRaw(data []byte) dbsm.Result {
+	sm.index++
+	entries, err := sm.update([]dbsm.Entry{{Index: sm.index, Cmd: data}})
+	if err != nil {
+		sm.t.Fatalf("failed to apply entry %d, %v", sm.index, err)
+	}
+	return entries[0].Result
+}
+
+func (sm *testFSM) propose(cmd Command) dbsm.Result {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		sm.t.Fatalf("failed to encode command, %v", err)
+	}
+	return sm.proposeRaw(data)
+}
+
+// mustPropose applies cmd and fails the test unless it succeeds.
+func (sm *testFSM) mustPropose(cmd Command) dbsm.Result {
+	res := sm.propose(cmd)
+	if res.Value != ResultCodeSuccess {
+		sm.t.Fatalf("command %+v failed, result %d, %s", cmd, res.Value, res.Data)
+	}
+	return res
+}
+
+// get returns the current entry of key.
+func (sm *testFSM) get(key string) (Entry, bool) {
+	val, err := sm.lookup(Query{Key: key})
+	if err != nil {
+		sm.t.Fatalf("failed to get %q, %v", key, err)
+	}
+	if val == nil {
+		return Entry{}, false
+	}
+	return val.(Entry), true
+}
+
+func TestTxn(t *testing.T) {
+	tests := []struct {
+		name      string
+		compare   []Compare
+		succeeded bool
+	}{
+		{"no comparisons", nil, true},
+		{"ver equal", []Compare{{Key: "a", Target: CompareTargetVer, Result: "=", Ver: 1}}, true},
+		{"ver not equal", []Compare{{Key: "a", Target: CompareTargetVer, Result: "!=", Ver: 1}}, false},
+		{"ver less", []Compare{{Key: "a", Target: CompareTargetVer, Result: "<", Ver: 2}}, true},
+		{"ver greater", []Compare{{Key: "a", Target: CompareTargetVer, Result: ">", Ver: 1}}, false},
+		{"val equal", []Compare{{Key: "a", Target: CompareTargetVal, Result: "=", Val: "1"}}, true},
+		{"val less", []Compare{{Key: "a", Target: CompareTargetVal, Result: "<", Val: "0"}}, false},
+		{"val greater", []Compare{{Key: "a", Target: CompareTargetVal, Result: ">", Val: "0"}}, true},
+		{"missing key has version 0", []Compare{{Key: "missing", Target: CompareTargetVer, Result: "=", Ver: 0}}, true},
+		{"missing key has empty value", []Compare{{Key: "missing", Target: CompareTargetVal, Result: "=", Val: ""}}, true},
+		{"all must hold", []Compare{
+			{Key: "a", Target: CompareTargetVer, Result: "=", Ver: 1},
+			{Key: "b", Target: CompareTargetVal, Result: "=", Val: "other"},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, historyOptions{}, func(t *testing.T, sm *testFSM) {
+				sm.mustPropose(Command{Entry: Entry{Key: "a", Val: "1"}})
+				sm.mustPropose(Command{Entry: Entry{Key: "b", Val: "2"}})
+				txn := &Txn{
+					Compare: tt.compare,
+					Then:    []Op{{Type: OpTypePut, Key: "then", Val: "x"}},
+					Else:    []Op{{Type: OpTypePut, Key: "else", Val: "x"}},
+				}
+				res := sm.mustPropose(Command{Type: CommandTypeTxn, Txn: txn})
+				var tr TxnResult
+				if err := json.Unmarshal(res.Data, &tr); err != nil {
+					t.Fatalf("failed to decode the result, %v", err)
+				}
+				if tr.Succeeded != tt.succeeded {
+					t.Errorf("succeeded %t, want %t", tr.Succeeded, tt.succeeded)
+				}
+				applied, skipped := "then", "else"
+				if !tt.succeeded {
+					applied, skipped = skipped, applied
+				}
+				if entry, ok := sm.get(applied); !ok || entry.Ver != 3 {
+					t.Errorf("%q is %+v, want version 3", applied, entry)
+				}
+				if _, ok := sm.get(skipped); ok {
+					t.Errorf("ops of the %s branch applied", skipped)
+				}
+			})
+		})
+	}
+}
+
+func TestTxnOps(t *testing.T) {
+	forEachStore(t, historyOptions{}, func(t *testing.T, sm *testFSM) {
+		sm.mustPropose(Command{Entry: Entry{Key: "a", Val: "1"}})
+		sm.mustPropose(Command{Entry: Entry{Key: "b", Val: "2"}})
+		txn := &Txn{
+			Then: []Op{
+				{Type: OpTypeGet, Key: "a"},
+				{Type: OpTypePut, Key: "a", Val: "3"},
+				{Type: OpTypeDelete, Key: "b"},
+				{Type: OpTypeGet, Key: "b"},
+				{Type: OpTypePut, Key: "c", Val: "4"},
+			},
+		}
+		res := sm.mustPropose(Command{Type: CommandTypeTxn, Txn: txn})
+		var tr TxnResult
+		if err := json.Unmarshal(res.Data, &tr); err != nil {
+			t.Fatalf("failed to decode the result, %v", err)
+		}
+		// ops see the changes of the earlier ops of the txn, all puts get
+		// the index of the txn as their version
+		want := TxnResult{
+			Succeeded: true,
+			Results: []Entry{
+				{Key: "a", Ver: 1, Val: "1"},
+				{Key: "a", Ver: 3, Val: "3"},
+				{Key: "b", Ver: 2, Val: "2"},
+				{Key: "b"},
+				{Key: "c", Ver: 3, Val: "4"},
+			},
+		}
+		if !reflect.DeepEqual(tr, want) {
+			t.Errorf("result %+v, want %+v", tr, want)
+		}
+		if _, ok := sm.get("b"); ok {
+			t.Errorf("b not deleted")
+		}
+		for key, val := range map[string]string{"a": "3", "c": "4"} {
+			if entry, ok := sm.get(key); !ok || entry.Val != val || entry.Ver != 3 {
+				t.Errorf("%q is %+v, want %q at version 3", key, entry, val)
+			}
+		}
+	})
+}
+
+func TestTxnWithoutMatchingBranchOps(t *testing.T) {
+	forEachStore(t, historyOptions{}, func(t *testing.T, sm *testFSM) {
+		txn := &Txn{
+			Compare: []Compare{{Key: "a", Target: CompareTargetVer, Result: ">", Ver: 0}},
+			Then:    []Op{{Type: OpTypePut, Key: "a", Val: "1"}},
+		}
+		res := sm.mustPropose(Command{Type: CommandTypeTxn, Txn: txn})
+		if !bytes.Equal(res.Data, []byte(`{"succeeded":false,"results":[]}`)) {
+			t.Errorf("unexpected result %s", res.Data)
+		}
+		if _, ok := sm.get("a"); ok {
+			t.Errorf("then ops applied when the comparison failed")
+		}
+	})
+}
+
+func TestPutMustExist(t *testing.T) {
+	forEachStore(t, historyOptions{count: 10}, func(t *testing.T, sm *testFSM) {
+		tests := []struct {
+			name string
+			cmd  Command
+			code uint64
+		}{
+			{"version of a missing key", Command{Entry: Entry{Key: "a", Ver: 5}, MustExist: true}, ResultCodeVersionMismatch},
+			{"any version of a missing key", Command{Entry: Entry{Key: "a"}, MustExist: true}, ResultCodeVersionMismatch},
+			{"create", Command{Entry: Entry{Key: "a", Val: "1"}}, ResultCodeSuccess},
+			{"create an existing key", Command{Entry: Entry{Key: "a"}}, ResultCodeVersionMismatch},
+			{"mismatched version", Command{Entry: Entry{Key: "a", Ver: 5}, MustExist: true}, ResultCodeVersionMismatch},
+			{"matching version", Command{Entry: Entry{Key: "a", Ver: 3, Val: "2"}, MustExist: true}, ResultCodeSuccess},
+			{"any version", Command{Entry: Entry{Key: "a", Val: "3"}, MustExist: true}, ResultCodeSuccess},
+			{"revert", Command{Type: CommandTypeRevert, Entry: Entry{Key: "a"}, Revert: 3, MustExist: true}, ResultCodeSuccess},
+			{"patch", Command{Type: CommandTypePatch, Entry: Entry{Key: "a"}, Patch: &Patch{Op: PatchOpIncr, By: 1}, MustExist: true}, ResultCodeSuccess},
+			{"patch a missing key", Command{Type: CommandTypePatch, Entry: Entry{Key: "b"}, Patch: &Patch{Op: PatchOpIncr, By: 1}, MustExist: true}, ResultCodeVersionMismatch},
+		}
+		for _, tt := range tests {
+			if res := sm.propose(tt.cmd); res.Value != tt.code {
+				t.Errorf("%s: result %d, want %d, %s", tt.name, res.Value, tt.code, res.Data)
+			}
+		}
+		// reverted to 1 and incremented
+		if entry, ok := sm.get("a"); !ok || entry.Val != "2" {
+			t.Errorf("a is %+v, want 2", entry)
+		}
+		if _, ok := sm.get("b"); ok {
+			t.Errorf("b created by a patch requiring it to exist")
+		}
+	})
+}
+
+func TestList(t *testing.T) {
+	forEachStore(t, historyOptions{}, func(t *testing.T, sm *testFSM) {
+		for _, key := range []string{"/a", "/b/1", "/b/2", "/b/3", "/b/4", "/b/5", "/c"} {
+			sm.mustPropose(Command{Entry: Entry{Key: key, Val: "v"}})
+		}
+		list := func(query ListQuery) ListResult {
+			res, err := sm.lookup(query)
+			if err != nil {
+				t.Fatalf("failed to list %+v, %v", query, err)
+			}
+			return res.(ListResult)
+		}
+		keys := func(res ListResult) []string {
+			keys := []string{}
+			for _, entry := range res.Entries {
+				keys = append(keys, entry.Key)
+			}
+			return keys
+		}
+		tests := []struct {
+			query ListQuery
+			keys  []string
+			next  string
+		}{
+			{ListQuery{}, []string{"/a", "/b/1", "/b/2", "/b/3", "/b/4", "/b/5", "/c"}, ""},
+			{ListQuery{Prefix: "/b/"}, []string{"/b/1", "/b/2", "/b/3", "/b/4", "/b/5"}, ""},
+			{ListQuery{Prefix: "/b/", Limit: 2}, []string{"/b/1", "/b/2"}, "/b/2"},
+			{ListQuery{Prefix: "/b/", Limit: 2, After: "/b/2"}, []string{"/b/3", "/b/4"}, "/b/4"},
+			{ListQuery{Prefix: "/b/", Limit: 2, After: "/b/4"}, []string{"/b/5"}, ""},
+			// a full page only has a next key when more entries follow
+			{ListQuery{Prefix: "/b/", Limit: 1, After: "/b/4"}, []string{"/b/5"}, ""},
+			{ListQuery{Prefix: "/b/", After: "/b/5"}, []string{}, ""},
+			// after doesn't have to be an existing key
+			{ListQuery{Prefix: "/b/", After: "/b/25"}, []string{"/b/3", "/b/4", "/b/5"}, ""},
+			// a key before the prefix starts at the prefix
+			{ListQuery{Prefix: "/b/", Limit: 1, After: "/a"}, []string{"/b/1"}, "/b/1"},
+			{ListQuery{Prefix: "/b/", After: "/c"}, []string{}, ""},
+			{ListQuery{Prefix: "/d"}, []string{}, ""},
+		}
+		for _, tt := range tests {
+			res := list(tt.query)
+			if got := keys(res); !reflect.DeepEqual(got, tt.keys) || res.Next != tt.next {
+				t.Errorf("list %+v returned %v next %q, want %v next %q", tt.query, got, res.Next, tt.keys, tt.next)
+			}
+		}
+		// following the next keys visits every key once
+		var all []string
+		query := ListQuery{Limit: 3}
+		for {
+			res := list(query)
+			all = append(all, keys(res)...)
+			if len(res.Next) == 0 {
+				break
+			}
+			query.After = res.Next
+		}
+		if len(all) != 7 {
+			t.Errorf("paginated listing returned %v", all)
+		}
+	})
+}
+
+func TestPoisonEntries(t *testing.T) {
+	encode := func(cmd Command) []byte {
+		b, err := json.Marshal(cmd)
+		if err != nil {
+			t.Fatalf("failed to encode command, %v", err)
+		}
+		return b
+	}
+	longKey := "/" + strings.Repeat("k", maxKeyLength)
+	largeVal := strings.Repeat("v", maxValueSize+1)
+	manyOps := make([]Op, maxTxnOps+1)
+	for i := range manyOps {
+		manyOps[i] = Op{Type: OpTypeGet, Key: fmt.Sprintf("/k%d", i)}
+	}
+	tests := []struct {
+		name string
+		cmd  []byte
+	}{
+		{"empty", []byte{}},
+		{"malformed JSON", []byte(`{"key":`)},
+		{"not an object", []byte(`[1,2,3]`)},
+		{"null", []byte(`null`)},
+		{"mistyped field", []byte(`{"key":"/a","ver":"1"}`)},
+		{"unknown type", []byte(`{"type":"compact","key":"/a"}`)},
+		{"missing key", encode(Command{Entry: Entry{Val: "v"}})},
+		{"oversized key", encode(Command{Entry: Entry{Key: longKey}})},
+		{"oversized value", encode(Command{Entry: Entry{Key: "/a", Val: largeVal}})},
+		{"reserved key", encode(Command{Entry: Entry{Key: lockKey("/a"), Val: "v"}})},
+		{"delete oversized key", encode(Command{Type: CommandTypeDelete, Entry: Entry{Key: longKey}})},
+		{"missing txn", encode(Command{Type: CommandTypeTxn})},
+		{"oversized txn", encode(Command{Type: CommandTypeTxn, Txn: &Txn{Then: manyOps}})},
+		{"txn oversized value", encode(Command{Type: CommandTypeTxn, Txn: &Txn{
+			Then: []Op{{Type: OpTypePut, Key: "/a", Val: largeVal}},
+		}})},
+		{"txn oversized key", encode(Command{Type: CommandTypeTxn, Txn: &Txn{
+			Compare: []Compare{{Key: longKey, Target: CompareTargetVer, Result: "="}},
+		}})},
+		{"txn invalid op", encode(Command{Type: CommandTypeTxn, Txn: &Txn{
+			Else: []Op{{Type: "incr", Key: "/a"}},
+		}})},
+		{"txn invalid compare", encode(Command{Type: CommandTypeTxn, Txn: &Txn{
+			Compare: []Compare{{Key: "/a", Target: CompareTargetVer, Result: "<="}},
+		}})},
+		{"missing patch", encode(Command{Type: CommandTypePatch, Entry: Entry{Key: "/a"}})},
+		{"invalid patch", encode(Command{Type: CommandTypePatch, Entry: Entry{Key: "/a"}, Patch: &Patch{Op: "mul"}})},
+		{"patch with invalid JSON", encode(Command{Type: CommandTypePatch, Entry: Entry{Key: "/a", Val: "{"},
+			Patch: &Patch{Op: PatchOpMerge}})},
+		{"lock without time", encode(Command{Type: CommandTypeLock, Entry: Entry{Key: "/l"}, TTL: int64(time.Second)})},
+		{"lock without ttl", encode(Command{Type: CommandTypeLock, Entry: Entry{Key: "/l"}, Time: 1})},
+		{"lock with oversized ttl", encode(Command{Type: CommandTypeLock, Entry: Entry{Key: "/l"},
+			TTL: int64(2 * maxLockTTL), Time: 1})},
+		{"invalid namespace", encode(Command{Type: CommandTypeCreateNamespace, Entry: Entry{Key: "a/b"}})},
+	}
+	forEachStore(t, historyOptions{count: 10}, func(t *testing.T, sm *testFSM) {
+		for _, tt := range tests {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("%s: state machine panicked, %v", tt.name, r)
+					}
+				}()
+				res := sm.proposeRaw(tt.cmd)
+				if res.Value != ResultCodeFailure || len(res.Data) == 0 {
+					t.Errorf("%s: result %d %q, want a failure with a reason", tt.name, res.Value, res.Data)
+				}
+			}()
+		}
+		// rejected entries are applied without changing the state
+		if res, err := sm.lookup(ListQuery{}); err != nil || len(res.(ListResult).Entries) != 0 {
+			t.Errorf("rejected entries changed the state, %v %v", res, err)
+		}
+		if res, err := sm.lookup(AppliedIndexQuery{}); err != nil || res.(uint64) != sm.index {
+			t.Errorf("applied index is %v, want %d, %v", res, sm.index, err)
+		}
+		sm.mustPropose(Command{Entry: Entry{Key: "/a", Val: "v"}})
+	})
+}
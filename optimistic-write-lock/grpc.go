@@ -0,0 +1,285 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative kvpb/kv.proto
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lni/dragonboat/v4"
+	dbsm "github.com/lni/dragonboat/v4/statemachine"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/lni/dragonboat-example/v3/optimistic-write-lock/kvpb"
+)
+
+// grpcServer implements the KV gRPC service on top of the same commands and
+// queries as the HTTP handler.
+type grpcServer struct {
+	kvpb.UnimplementedKVServer
+	nh      *dragonboat.NodeHost
+	hub     *watchHub
+	limiter *limiter
+}
+
+func newGRPCServer(nh *dragonboat.NodeHost, hub *watchHub, lim *limiter) *grpcServer {
+	return &grpcServer{nh: nh, hub: hub, limiter: lim}
+}
+
+// admit sheds the call when the node serves too many requests, it returns the
+// function releasing the admitted call.
+func (s *grpcServer) admit() (func(), error) {
+	if !s.limiter.acquire() {
+		return nil, status.Error(codes.ResourceExhausted, "Too many requests in flight")
+	}
+	return s.limiter.release, nil
+}
+
+func (s *grpcServer) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.Entry, error) {
+	release, err := s.admit()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := validateKey(req.Key); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	res, err := s.nh.SyncRead(ctx, shardID, Query{Key: req.Key, Token: grpcToken(ctx)})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	entry, ok := res.(Entry)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Key %q not found", req.Key)
+	}
+	return toPB(entry), nil
+}
+
+func (s *grpcServer) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.Entry, error) {
+	cmd := Command{
+		Entry: Entry{Key: req.Key, Ver: req.ExpectedVersion, Val: req.Value},
+		// a non-zero version never matches a missing key
+		MustExist: req.ExpectedVersion != 0,
+	}
+	return s.propose(ctx, cmd)
+}
+
+func (s *grpcServer) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.Entry, error) {
+	cmd := Command{
+		Type:  CommandTypeDelete,
+		Entry: Entry{Key: req.Key, Ver: req.ExpectedVersion},
+	}
+	return s.propose(ctx, cmd)
+}
+
+func (s *grpcServer) List(ctx context.Context, req *kvpb.ListRequest) (*kvpb.ListResponse, error) {
+	release, err := s.admit()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultListLimit
+	}
+	if limit < 0 || limit > maxListLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "Limit must be between 1 and %d", maxListLimit)
+	}
+	query := ListQuery{
+		Prefix: req.Prefix,
+		After:  req.After,
+		Limit:  limit,
+		Token:  grpcToken(ctx),
+	}
+	res, err := s.nh.SyncRead(ctx, shardID, query)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	result := res.(ListResult)
+	resp := &kvpb.ListResponse{Next: result.Next}
+	for _, entry := range result.Entries {
+		resp.Entries = append(resp.Entries, toPB(entry))
+	}
+	return resp, nil
+}
+
+// Watch streams the changes applied by the local replica. The principal is
+// resolved once when the watch starts, ACL changes made afterwards don't
+// affect the stream.
+func (s *grpcServer) Watch(req *kvpb.WatchRequest, stream kvpb.KV_WatchServer) error {
+	// watchers only hold a slot of the limiter while being authenticated
+	release, err := s.admit()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withDefaultTimeout(stream.Context())
+	res, err := s.nh.SyncRead(ctx, shardID, WatchQuery{Token: grpcToken(stream.Context())})
+	cancel()
+	release()
+	if err != nil {
+		return grpcError(err)
+	}
+	w, err := s.hub.subscribe(req.Prefix, res.(Principal))
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer s.hub.unsubscribe(w)
+	for {
+		select {
+		case e, ok := <-w.ch:
+			if !ok {
+				code := codes.Unavailable
+				if w.err == ErrWatcherLagging {
+					code = codes.DataLoss
+				}
+				return status.Error(code, w.err.Error())
+			}
+			event := &kvpb.Event{Type: kvpb.Event_PUT, Entry: toPB(e.Entry), Index: e.Index}
+			if e.Type == EventTypeDelete {
+				event.Type = kvpb.Event_DELETE
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+// propose proposes cmd and maps the result code of the state machine to a
+// gRPC status.
+func (s *grpcServer) propose(ctx context.Context, cmd Command) (*kvpb.Entry, error) {
+	release, err := s.admit()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	cmd.Token = grpcToken(ctx)
+	cmd.Time = time.Now().UnixNano()
+	if err := cmd.validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	res, err := s.nh.SyncPropose(ctx, s.nh.GetNoOPSession(shardID), b)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	switch res.Value {
+	case ResultCodeSuccess:
+		var entry Entry
+		json.Unmarshal(res.Data, &entry)
+		return toPB(entry), nil
+	case ResultCodeVersionMismatch:
+		return nil, versionConflict(cmd.Entry, res)
+	case ResultCodeNotFound:
+		return nil, status.Errorf(codes.NotFound, "Key %q not found", cmd.Key)
+	case ResultCodeUnauthenticated:
+		return nil, status.Error(codes.Unauthenticated, ErrUnauthenticated.Error())
+	case ResultCodePermissionDenied:
+		return nil, status.Error(codes.PermissionDenied, ErrPermissionDenied.Error())
+	default:
+		return nil, status.Error(codes.InvalidArgument, string(res.Data))
+	}
+}
+
+// versionConflict returns the ABORTED status of a rejected write, its
+// VersionConflict detail carries the current version of the key.
+func versionConflict(expected Entry, res dbsm.Result) error {
+	var current Entry
+	json.Unmarshal(res.Data, &current)
+	st := status.New(codes.Aborted,
+		fmt.Sprintf("Version mismatch (%d != %d)", expected.Ver, current.Ver))
+	detailed, err := st.WithDetails(&kvpb.VersionConflict{
+		Key:             expected.Key,
+		ExpectedVersion: expected.Ver,
+		CurrentVersion:  current.Ver,
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// grpcError maps the error of a failed read or proposal to a gRPC status.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, ErrPermissionDenied):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	switch _, code, _ := raftError(err); code {
+	case ErrorCodeTimeout:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case ErrorCodeSystemBusy:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case ErrorCodeShardNotReady, ErrorCodeRejected, ErrorCodeAborted, ErrorCodeUnavailable, ErrorCodeCanceled:
+		return status.Error(codes.Unavailable, err.Error())
+	case ErrorCodePayloadTooBig, ErrorCodeBadRequest:
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// withDefaultTimeout applies the default request timeout to calls made
+// without a deadline and caps the deadline of the others, proposals and reads
+// require a deadline.
+func withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= maxTimeout {
+		return context.WithCancel(ctx)
+	} else if ok {
+		return context.WithTimeout(ctx, maxTimeout)
+	}
+	return context.WithTimeout(ctx, defaultTimeout)
+}
+
+// grpcToken returns the hash of the bearer token in the authorization
+// metadata of the call.
+func grpcToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, v := range md.Get("authorization") {
+		if strings.HasPrefix(v, "Bearer ") {
+			return hashToken(strings.TrimSpace(strings.TrimPrefix(v, "Bearer ")))
+		}
+	}
+	return ""
+}
+
+func toPB(entry Entry) *kvpb.Entry {
+	return &kvpb.Entry{Key: entry.Key, Version: entry.Ver, Value: entry.Val}
+}
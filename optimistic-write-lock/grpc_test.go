@@ -0,0 +1,231 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/lni/dragonboat-example/v3/optimistic-write-lock/kvpb"
+)
+
+// startGRPCTestNode starts a single node and serves its gRPC service on an in
+// memory listener, it returns the node, the URL of its HTTP API and a client
+// of the service.
+func startGRPCTestNode(t *testing.T) (*node, string, kvpb.KVClient) {
+	n, url := startTestNode(t)
+	l := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	kvpb.RegisterKVServer(s, newGRPCServer(n.nh, n.hub, newLimiter(0)))
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	dial := func(ctx context.Context, _ string) (net.Conn, error) {
+		return l.DialContext(ctx)
+	}
+	conn, err := grpc.Dial("bufnet", grpc.WithContextDialer(dial),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial, %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return n, url, kvpb.NewKVClient(conn)
+}
+
+func expectCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("got %v, want %v", err, code)
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	n, url, client := startGRPCTestNode(t)
+	ctx := context.Background()
+
+	t.Run("crud", func(t *testing.T) {
+		put, err := client.Put(ctx, &kvpb.PutRequest{Key: "/crud/a", Value: "1"})
+		if err != nil {
+			t.Fatalf("put failed, %v", err)
+		}
+		if put.Version == 0 || put.Value != "1" {
+			t.Fatalf("unexpected put result %v", put)
+		}
+		got, err := client.Get(ctx, &kvpb.GetRequest{Key: "/crud/a"})
+		if err != nil {
+			t.Fatalf("get failed, %v", err)
+		}
+		if got.Version != put.Version || got.Value != "1" {
+			t.Errorf("got %v, want %v", got, put)
+		}
+		if _, err := client.Put(ctx, &kvpb.PutRequest{Key: "/crud/b", Value: "2"}); err != nil {
+			t.Fatalf("put failed, %v", err)
+		}
+		list, err := client.List(ctx, &kvpb.ListRequest{Prefix: "/crud/", Limit: 1})
+		if err != nil {
+			t.Fatalf("list failed, %v", err)
+		}
+		if len(list.Entries) != 1 || list.Entries[0].Key != "/crud/a" || list.Next != "/crud/a" {
+			t.Errorf("unexpected first page %v", list)
+		}
+		list, err = client.List(ctx, &kvpb.ListRequest{Prefix: "/crud/", After: list.Next})
+		if err != nil {
+			t.Fatalf("list failed, %v", err)
+		}
+		if len(list.Entries) != 1 || list.Entries[0].Key != "/crud/b" || len(list.Next) > 0 {
+			t.Errorf("unexpected last page %v", list)
+		}
+		deleted, err := client.Delete(ctx, &kvpb.DeleteRequest{Key: "/crud/a", ExpectedVersion: put.Version})
+		if err != nil {
+			t.Fatalf("delete failed, %v", err)
+		}
+		if deleted.Version != put.Version {
+			t.Errorf("deleted %v, want %v", deleted, put)
+		}
+		_, err = client.Get(ctx, &kvpb.GetRequest{Key: "/crud/a"})
+		expectCode(t, err, codes.NotFound)
+		_, err = client.Delete(ctx, &kvpb.DeleteRequest{Key: "/crud/a"})
+		expectCode(t, err, codes.NotFound)
+		_, err = client.Get(ctx, &kvpb.GetRequest{Key: "/_acl/root"})
+		expectCode(t, err, codes.InvalidArgument)
+	})
+
+	t.Run("version conflict", func(t *testing.T) {
+		put, err := client.Put(ctx, &kvpb.PutRequest{Key: "/conflict", Value: "1"})
+		if err != nil {
+			t.Fatalf("put failed, %v", err)
+		}
+		check := func(err error, expected uint64) {
+			t.Helper()
+			expectCode(t, err, codes.Aborted)
+			details := status.Convert(err).Details()
+			if len(details) != 1 {
+				t.Fatalf("got %d details", len(details))
+			}
+			conflict, ok := details[0].(*kvpb.VersionConflict)
+			if !ok {
+				t.Fatalf("unexpected detail %T", details[0])
+			}
+			if conflict.Key != "/conflict" || conflict.ExpectedVersion != expected ||
+				conflict.CurrentVersion != put.Version {
+				t.Errorf("unexpected conflict %v", conflict)
+			}
+		}
+		_, err = client.Put(ctx, &kvpb.PutRequest{Key: "/conflict", Value: "2", ExpectedVersion: put.Version + 1})
+		check(err, put.Version+1)
+		_, err = client.Delete(ctx, &kvpb.DeleteRequest{Key: "/conflict", ExpectedVersion: 1})
+		check(err, 1)
+		// a non-zero expected version doesn't match a missing key
+		_, err = client.Put(ctx, &kvpb.PutRequest{Key: "/missing", Value: "1", ExpectedVersion: 1})
+		expectCode(t, err, codes.Aborted)
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		wctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stream, err := client.Watch(wctx, &kvpb.WatchRequest{Prefix: "/watch/"})
+		if err != nil {
+			t.Fatalf("watch failed, %v", err)
+		}
+		// the stream is established once the server subscribed
+		for deadline := time.Now().Add(5 * time.Second); watchers(n.hub) == 0; {
+			if time.Now().After(deadline) {
+				t.Fatalf("the watcher wasn't subscribed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		put, err := client.Put(ctx, &kvpb.PutRequest{Key: "/watch/a", Value: "1"})
+		if err != nil {
+			t.Fatalf("put failed, %v", err)
+		}
+		if _, err := client.Put(ctx, &kvpb.PutRequest{Key: "/other", Value: "1"}); err != nil {
+			t.Fatalf("put failed, %v", err)
+		}
+		if _, err := client.Delete(ctx, &kvpb.DeleteRequest{Key: "/watch/a"}); err != nil {
+			t.Fatalf("delete failed, %v", err)
+		}
+		e, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("recv failed, %v", err)
+		}
+		if e.Type != kvpb.Event_PUT || e.Entry.Key != "/watch/a" || e.Index != put.Version {
+			t.Errorf("unexpected event %v", e)
+		}
+		e, err = stream.Recv()
+		if err != nil {
+			t.Fatalf("recv failed, %v", err)
+		}
+		if e.Type != kvpb.Event_DELETE || e.Entry.Key != "/watch/a" {
+			t.Errorf("unexpected event %v", e)
+		}
+		cancel()
+		_, err = stream.Recv()
+		expectCode(t, err, codes.Canceled)
+		for deadline := time.Now().Add(5 * time.Second); watchers(n.hub) > 0; {
+			if time.Now().After(deadline) {
+				t.Fatalf("the watcher wasn't unsubscribed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	// access control stays enabled once enabled, it is tested last
+	t.Run("auth", func(t *testing.T) {
+		req, _ := http.NewRequest("PUT", url+"/admin/acl/root", strings.NewReader(`{"token":"secret","admin":true}`))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to add the principal, %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("adding the principal returned %d", resp.StatusCode)
+		}
+		_, err = client.Put(ctx, &kvpb.PutRequest{Key: "/auth", Value: "1"})
+		expectCode(t, err, codes.Unauthenticated)
+		_, err = client.List(ctx, &kvpb.ListRequest{Prefix: "/"})
+		expectCode(t, err, codes.Unauthenticated)
+		wrong := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer wrong")
+		_, err = client.Get(wrong, &kvpb.GetRequest{Key: "/auth"})
+		expectCode(t, err, codes.Unauthenticated)
+		stream, err := client.Watch(wrong, &kvpb.WatchRequest{Prefix: "/"})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		expectCode(t, err, codes.Unauthenticated)
+		authed := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+		if _, err := client.Put(authed, &kvpb.PutRequest{Key: "/auth", Value: "1"}); err != nil {
+			t.Fatalf("put with the token failed, %v", err)
+		}
+		if _, err := client.Get(authed, &kvpb.GetRequest{Key: "/auth"}); err != nil {
+			t.Fatalf("get with the token failed, %v", err)
+		}
+	})
+}
+
+func watchers(hub *watchHub) int {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return len(hub.watchers)
+}
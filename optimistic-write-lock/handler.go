@@ -17,83 +17,727 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/lni/dragonboat/v4"
+	dbsm "github.com/lni/dragonboat/v4/statemachine"
+
+	"github.com/lni/dragonboat-example/v3/status"
+)
+
+// statusPaths are served by the status handler.
+var statusPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/status":  true,
+}
+
+// Read consistency levels. Linearizable reads go through SyncRead, stale
+// reads query the local replica and batched reads are linearizable reads
+// coalesced behind a single ReadIndex per batch. ConsistencyLease is accepted
+// as an alias of ConsistencyBatched, the name batched reads were introduced
+// with.
+const (
+	ConsistencyLinearizable = "linearizable"
+	ConsistencyStale        = "stale"
+	ConsistencyBatched      = "batched"
+	ConsistencyLease        = "lease"
+)
+
+// errBadMinIndex and errBadConsistency are returned by read for invalid read
+// options.
+var (
+	errBadMinIndex    = errors.New(headerMinIndex + " must be uint64")
+	errBadConsistency = errors.New("Consistency must be one of linearizable, stale, batched and lease")
+)
+
+const (
+	defaultListLimit = 100
+	defaultTimeout   = time.Second
+	maxTimeout       = 30 * time.Second
+	headerTimeout    = "X-Request-Timeout"
+	headerMinIndex   = "X-Min-Index"
+	// minIndexWait bounds the time a read waits for the local replica to apply
+	// its minimum index before falling back to a linearizable read
+	minIndexWait = 100 * time.Millisecond
 )
 
 type handler struct {
-	nh *dragonboat.NodeHost
+	nh        *dragonboat.NodeHost
+	shardID   uint64
+	replicaID uint64
+	fwd       *forwarder
+	status    *status.Handler
+	limiter   *limiter
+	index     *appliedIndex
+	hub       *watchHub
+	batcher   *readBatcher
+	// prefix is the path prefix of the namespace served by the handler
+	prefix string
+	// exportDir is the directory the snapshots of the shard are exported to
+	exportDir string
+	// router serves the namespaces, it is only set on the handler of the
+	// default shard
+	router *namespaceRouter
+}
+
+func newHandler(nh *dragonboat.NodeHost, shardID, replicaID uint64, fwd *forwarder,
+	lim *limiter, index *appliedIndex, hub *watchHub) *handler {
+	return &handler{
+		nh:        nh,
+		shardID:   shardID,
+		replicaID: replicaID,
+		fwd:       fwd,
+		limiter:   lim,
+		index:     index,
+		hub:       hub,
+		batcher:   newReadBatcher(nh, shardID),
+		status: &status.Handler{
+			NodeHost: nh,
+			AppliedIndex: func(shardID uint64) (uint64, error) {
+				v, err := nh.StaleRead(shardID, AppliedIndexQuery{})
+				if err != nil {
+					return 0, err
+				}
+				return v.(uint64), nil
+			},
+		},
+	}
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	defer w.Write([]byte("\n"))
-	var err error
-	ctx, _ := context.WithTimeout(context.Background(), time.Second)
-	if r.Method == "GET" {
-		query := Query{
-			Key: r.URL.Path,
+	if h.router != nil && strings.HasPrefix(r.URL.Path, nsPrefix) {
+		h.router.ServeHTTP(w, r)
+		return
+	}
+	// requests are forwarded with the namespace prefix of their path
+	if h.fwd != nil && h.fwd.forward(h, w, r) {
+		return
+	}
+	if len(h.prefix) > 0 {
+		http.StripPrefix(h.prefix, http.HandlerFunc(h.serve)).ServeHTTP(w, r)
+		return
+	}
+	h.serve(w, r)
+}
+
+// newlineWriter records the status of a response so that the trailing newline
+// is only written on responses that can have a body.
+type newlineWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *newlineWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *newlineWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *newlineWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *newlineWriter) writeNewline() {
+	if w.status != 204 && w.status != 304 {
+		w.Write([]byte("\n"))
+	}
+}
+
+func (h *handler) serve(rw http.ResponseWriter, r *http.Request) {
+	w := &newlineWriter{ResponseWriter: rw}
+	defer w.writeNewline()
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		writeError(w, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	// requests are canceled when the client goes away
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	if r.Method == "GET" && r.URL.Path == "/metrics" {
+		metrics.WritePrometheus(w, true)
+	} else if statusPaths[r.URL.Path] {
+		h.status.ServeHTTP(w, r)
+	} else if isWatchRequest(r) {
+		h.watch(ctx, w, r)
+	} else if strings.HasPrefix(r.URL.Path, lockPrefix) {
+		h.lock(ctx, w, r)
+	} else if isWaitRequest(r) && r.Method == "GET" {
+		h.wait(ctx, w, r)
+	} else if !h.limiter.acquire() {
+		writeOverloaded(w)
+	} else {
+		defer h.limiter.release()
+		h.route(ctx, w, r)
+	}
+}
+
+// route serves the requests made on the shard.
+func (h *handler) route(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/admin/members" || strings.HasPrefix(r.URL.Path, "/admin/members/") {
+		h.members(ctx, w, r)
+	} else if r.URL.Path == "/admin/acl" || strings.HasPrefix(r.URL.Path, "/admin/acl/") {
+		h.acl(ctx, w, r)
+	} else if r.URL.Path == "/admin/snapshots" {
+		h.snapshots(ctx, w, r)
+	} else if h.router != nil && (r.URL.Path == "/admin/namespaces" || strings.HasPrefix(r.URL.Path, "/admin/namespaces/")) {
+		h.namespaces(ctx, w, r)
+	} else if r.Method == "GET" {
+		h.get(ctx, w, r)
+	} else if r.Method == "PUT" {
+		h.put(ctx, w, r)
+	} else if r.Method == "DELETE" {
+		h.delete(ctx, w, r)
+	} else if r.Method == "PATCH" {
+		h.patch(ctx, w, r)
+	} else if r.Method == "POST" && r.URL.Path == "/txn" {
+		h.txn(ctx, w, r)
+	} else {
+		writeError(w, 405, ErrorCodeMethodNotAllowed, "Method not supported")
+	}
+}
+
+func (h *handler) get(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if isListRequest(r) {
+		h.list(ctx, w, r)
+		return
+	}
+	if err := validateKey(r.URL.Path); err != nil {
+		writeError(w, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	if r.FormValue("history") == "true" {
+		h.history(ctx, w, r)
+		return
+	}
+	query := Query{
+		Key:   r.URL.Path,
+		Token: token(r),
+	}
+	if v := r.FormValue("ver"); len(v) > 0 {
+		ver, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || ver == 0 {
+			writeError(w, 400, ErrorCodeBadRequest, "Version must be a positive uint64")
+			return
 		}
-		res, err := h.nh.SyncRead(ctx, shardID, query)
+		query.Ver = ver
+	}
+	res, err := h.read(ctx, r, query)
+	if err != nil {
+		h.readError(w, err)
+		return
+	}
+	entry, ok := res.(Entry)
+	if !ok {
+		writeError(w, 404, ErrorCodeNotFound, "Not Found")
+		return
+	}
+	w.Header().Set("ETag", etag(entry.Ver))
+	if ver, ok := parseETag(r.Header.Get("If-None-Match")); ok && ver == entry.Ver {
+		w.WriteHeader(304)
+		return
+	}
+	b, _ := json.Marshal(entry)
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+// read reads query with the consistency level of the request. Requests with
+// a minimum index are served from the local replica once it has applied that
+// index, so a client sees its own earlier writes without the cost of a
+// linearizable read.
+func (h *handler) read(ctx context.Context, r *http.Request, query interface{}) (interface{}, error) {
+	consistency := r.FormValue("consistency")
+	switch consistency {
+	case "", ConsistencyLinearizable, ConsistencyBatched:
+	case ConsistencyLease:
+		consistency = ConsistencyBatched
+	case ConsistencyStale:
+		if len(r.Header.Get(headerMinIndex)) == 0 {
+			return h.nh.StaleRead(h.shardID, query)
+		}
+	default:
+		return nil, errBadConsistency
+	}
+	if v := r.Header.Get(headerMinIndex); len(v) > 0 {
+		index, err := strconv.ParseUint(v, 10, 64)
 		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
+			return nil, errBadMinIndex
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, minIndexWait)
+		err = h.index.wait(waitCtx, index)
+		cancel()
+		if err == nil {
+			return h.nh.StaleRead(h.shardID, query)
+		}
+		metrics.GetOrCreateCounter("optimistic_write_lock_min_index_fallbacks_total").Inc()
+	}
+	if consistency == ConsistencyBatched {
+		return h.batcher.read(ctx, query)
+	}
+	return h.nh.SyncRead(ctx, h.shardID, query)
+}
+
+// requestTimeout returns the timeout of the request set in its timeout header
+// as a Go duration string, e.g. 500ms or 5s.
+func requestTimeout(r *http.Request) (time.Duration, error) {
+	v := r.Header.Get(headerTimeout)
+	if len(v) == 0 && isWaitRequest(r) {
+		return defaultWaitTimeout, nil
+	} else if len(v) == 0 {
+		return defaultTimeout, nil
+	}
+	timeout, err := time.ParseDuration(v)
+	if err != nil || timeout <= 0 || timeout > maxTimeout {
+		return 0, fmt.Errorf("%s must be a duration between 0 and %s", headerTimeout, maxTimeout)
+	}
+	return timeout, nil
+}
+
+// isListRequest returns whether a GET on the root path asks for a listing
+// rather than the value of the key "/".
+func isListRequest(r *http.Request) bool {
+	if r.URL.Path != "/" {
+		return false
+	}
+	q := r.URL.Query()
+	return q.Has("prefix") || q.Has("after") || q.Has("limit")
+}
+
+func (h *handler) list(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	query := ListQuery{
+		Prefix: r.FormValue("prefix"),
+		After:  r.FormValue("after"),
+		Limit:  defaultListLimit,
+		Token:  token(r),
+	}
+	if len(r.FormValue("limit")) > 0 {
+		limit, err := strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			writeError(w, 400, ErrorCodeBadRequest, fmt.Sprintf("Limit must be between 1 and %d", maxListLimit))
 			return
 		}
-		if _, ok := res.(Entry); !ok {
-			w.WriteHeader(404)
-			w.Write([]byte("Not Found"))
+		query.Limit = limit
+	}
+	res, err := h.read(ctx, r, query)
+	if err != nil {
+		h.readError(w, err)
+		return
+	}
+	b, _ := json.Marshal(res.(ListResult))
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+// history writes the current entry and the prior versions of a key.
+func (h *handler) history(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	res, err := h.read(ctx, r, HistoryQuery{Key: r.URL.Path, Token: token(r)})
+	if err != nil {
+		h.readError(w, err)
+		return
+	}
+	b, _ := json.Marshal(res.(History))
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+// put sets the value of a key, or reverts it to the value of the version in
+// the revert parameter.
+func (h *handler) put(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	exp, ok := h.precondition(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("If-None-Match") == "*" {
+		// existing keys never have version 0, the put only succeeds when the key
+		// doesn't exist yet
+		exp = expectation{conditional: true}
+	}
+	cmd := Command{
+		Entry: Entry{
+			Key: r.URL.Path,
+			Ver: exp.ver,
+			Val: r.FormValue("val"),
+		},
+		MustExist: exp.mustExist,
+		Token:     token(r),
+	}
+	if v := r.FormValue("revert"); len(v) > 0 {
+		revert, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || revert == 0 {
+			writeError(w, 400, ErrorCodeBadRequest, "Revert version must be a positive uint64")
 			return
 		}
-		b, _ := json.Marshal(res.(Entry))
-		w.WriteHeader(200)
-		w.Write(b)
-	} else if r.Method == "PUT" {
-		var ver int
-		if len(r.FormValue("ver")) > 0 {
-			ver, err = strconv.Atoi(r.FormValue("ver"))
-			if err != nil {
-				w.WriteHeader(400)
-				w.Write([]byte("Version must be uint64"))
-				return
-			}
+		cmd.Type = CommandTypeRevert
+		cmd.Revert = revert
+		cmd.Val = ""
+	}
+	res, ok := h.propose(ctx, w, cmd)
+	if !ok {
+		return
+	}
+	if res.Value == ResultCodeVersionMismatch {
+		h.versionMismatch(w, exp, res)
+		return
+	}
+	if res.Value == ResultCodeNotFound {
+		writeError(w, 404, ErrorCodeNotFound, fmt.Sprintf("Version %d not found", cmd.Revert))
+		return
+	}
+	var entry Entry
+	json.Unmarshal(res.Data, &entry)
+	w.Header().Set("ETag", etag(entry.Ver))
+	w.WriteHeader(200)
+	w.Write(res.Data)
+}
+
+// patch applies the atomic operation in the op parameter to the value of a
+// key.
+func (h *handler) patch(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	exp, ok := h.precondition(w, r)
+	if !ok {
+		return
+	}
+	p := Patch{Op: r.FormValue("op"), By: 1}
+	var err error
+	if v := r.FormValue("by"); len(v) > 0 {
+		if p.By, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, 400, ErrorCodeBadRequest, "By must be int64")
+			return
 		}
-		var entry = Entry{
+	}
+	if p.Min, err = intParam(r, "min"); err != nil {
+		writeError(w, 400, ErrorCodeBadRequest, "Min must be int64")
+		return
+	}
+	if p.Max, err = intParam(r, "max"); err != nil {
+		writeError(w, 400, ErrorCodeBadRequest, "Max must be int64")
+		return
+	}
+	cmd := Command{
+		Type: CommandTypePatch,
+		Entry: Entry{
 			Key: r.URL.Path,
-			Ver: uint64(ver),
+			Ver: exp.ver,
 			Val: r.FormValue("val"),
+		},
+		Patch:     &p,
+		MustExist: exp.mustExist,
+		Token:     token(r),
+	}
+	res, ok := h.propose(ctx, w, cmd)
+	if !ok {
+		return
+	}
+	if res.Value == ResultCodeVersionMismatch {
+		h.versionMismatch(w, exp, res)
+		return
+	}
+	if res.Value == ResultCodeOutOfRange {
+		var current Entry
+		json.Unmarshal(res.Data, &current)
+		w.Header().Set("ETag", etag(current.Ver))
+		writeAPIError(w, 409, apiError{
+			Code:    ErrorCodeOutOfRange,
+			Message: fmt.Sprintf("Result of %s is out of range", p.Op),
+			Version: current.Ver,
+		})
+		return
+	}
+	var entry Entry
+	json.Unmarshal(res.Data, &entry)
+	w.Header().Set("ETag", etag(entry.Ver))
+	w.WriteHeader(200)
+	w.Write(res.Data)
+}
+
+// intParam returns the int64 value of an optional parameter, nil when it is
+// not set.
+func intParam(r *http.Request, name string) (*int64, error) {
+	v := r.FormValue(name)
+	if len(v) == 0 {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func (h *handler) delete(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	exp, ok := h.precondition(w, r)
+	if !ok {
+		return
+	}
+	if len(r.Header.Get("If-None-Match")) > 0 {
+		writeError(w, 400, ErrorCodeBadRequest, "If-None-Match is not supported on DELETE")
+		return
+	}
+	cmd := Command{
+		Type: CommandTypeDelete,
+		Entry: Entry{
+			Key: r.URL.Path,
+			Ver: exp.ver,
+		},
+		Token: token(r),
+	}
+	res, ok := h.propose(ctx, w, cmd)
+	if !ok {
+		return
+	}
+	if res.Value == ResultCodeNotFound {
+		if exp.conditional {
+			writeError(w, 412, ErrorCodePreconditionFailed, "Not Found")
+		} else {
+			writeError(w, 404, ErrorCodeNotFound, "Not Found")
 		}
-		b, err := json.Marshal(entry)
+		return
+	}
+	if res.Value == ResultCodeVersionMismatch {
+		h.versionMismatch(w, exp, res)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(res.Data)
+}
+
+func (h *handler) txn(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var txn Txn
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		writeError(w, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	res, ok := h.propose(ctx, w, Command{Type: CommandTypeTxn, Txn: &txn, Token: token(r)})
+	if !ok {
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(res.Data)
+}
+
+// propose proposes cmd and writes the error response when the proposal failed
+// or was rejected by the state machine.
+func (h *handler) propose(ctx context.Context, w http.ResponseWriter, cmd Command) (dbsm.Result, bool) {
+	cmd.Time = time.Now().UnixNano()
+	if err := cmd.validate(); err != nil {
+		writeError(w, 400, ErrorCodeBadRequest, err.Error())
+		return dbsm.Result{}, false
+	}
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		writeError(w, 400, ErrorCodeBadRequest, err.Error())
+		return dbsm.Result{}, false
+	}
+	res, err := h.nh.SyncPropose(ctx, h.nh.GetNoOPSession(h.shardID), b)
+	if err != nil {
+		writeRaftError(w, err)
+		return res, false
+	}
+	if res.Value == ResultCodeFailure {
+		writeError(w, 400, ErrorCodeBadRequest, string(res.Data))
+		return res, false
+	}
+	if res.Value == ResultCodeUnauthenticated {
+		h.denied(w, ErrUnauthenticated)
+		return res, false
+	}
+	if res.Value == ResultCodePermissionDenied {
+		h.denied(w, ErrPermissionDenied)
+		return res, false
+	}
+	return res, true
+}
+
+// readError writes the error response of a failed read.
+func (h *handler) readError(w http.ResponseWriter, err error) {
+	if err == errBadMinIndex || err == errBadConsistency {
+		writeError(w, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, ErrUnauthenticated) || errors.Is(err, ErrPermissionDenied) {
+		h.denied(w, err)
+		return
+	}
+	writeRaftError(w, err)
+}
+
+// denied rejects a request made with an unknown token with 401 and a request
+// the principal has no permission for with 403.
+func (h *handler) denied(w http.ResponseWriter, err error) {
+	status, code := 403, ErrorCodePermissionDenied
+	if errors.Is(err, ErrUnauthenticated) {
+		status, code = 401, ErrorCodeUnauthenticated
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	metrics.GetOrCreateCounter(fmt.Sprintf(`optimistic_write_lock_denied_requests_total{code="%d"}`, status)).Inc()
+	writeError(w, status, code, err.Error())
+}
+
+// token returns the hash of the bearer token of the request.
+func token(r *http.Request) string {
+	v := r.Header.Get("Authorization")
+	if !strings.HasPrefix(v, "Bearer ") {
+		return ""
+	}
+	return hashToken(strings.TrimSpace(strings.TrimPrefix(v, "Bearer ")))
+}
+
+type principalRequest struct {
+	Token       string       `json:"token"`
+	Admin       bool         `json:"admin"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// acl serves the admin endpoints listing, setting and deleting principals.
+func (h *handler) acl(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/acl"), "/")
+	if r.Method == "GET" && len(name) == 0 {
+		res, err := h.nh.SyncRead(ctx, h.shardID, ACLQuery{Token: token(r)})
 		if err != nil {
-			w.WriteHeader(400)
-			w.Write([]byte(err.Error()))
+			h.readError(w, err)
 			return
 		}
-		res, err := h.nh.SyncPropose(ctx, h.nh.GetNoOPSession(shardID), b)
-		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
+		b, _ := json.Marshal(res)
+		w.WriteHeader(200)
+		w.Write(b)
+		return
+	}
+	if len(name) == 0 {
+		writeError(w, 405, ErrorCodeMethodNotAllowed, "Method not supported")
+		return
+	}
+	cmd := Command{Token: token(r)}
+	if r.Method == "PUT" {
+		var req principalRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, 400, ErrorCodeBadRequest, err.Error())
 			return
 		}
-		if res.Value == ResultCodeFailure {
-			w.WriteHeader(400)
-			w.Write(res.Data)
-			return
+		p := Principal{
+			Name:        name,
+			TokenHash:   hashToken(req.Token),
+			Admin:       req.Admin,
+			Permissions: req.Permissions,
 		}
-		if res.Value == ResultCodeVersionMismatch {
-			var result Entry
-			json.Unmarshal(res.Data, &result)
-			w.WriteHeader(409)
-			w.Write([]byte(fmt.Sprintf("Version mismatch (%d != %d)", entry.Ver, result.Ver)))
+		if err := p.validate(); err != nil {
+			writeError(w, 400, ErrorCodeBadRequest, err.Error())
 			return
 		}
-		w.WriteHeader(200)
-		w.Write(res.Data)
+		b, _ := json.Marshal(p)
+		cmd.Type = CommandTypeSetPrincipal
+		cmd.Val = string(b)
+	} else if r.Method == "DELETE" {
+		cmd.Type = CommandTypeDeletePrincipal
+		cmd.Key = name
+	} else {
+		writeError(w, 405, ErrorCodeMethodNotAllowed, "Method not supported")
+		return
+	}
+	res, ok := h.propose(ctx, w, cmd)
+	if !ok {
+		return
+	}
+	if res.Value == ResultCodeNotFound {
+		writeError(w, 404, ErrorCodeNotFound, "Not Found")
+		return
+	}
+	if res.Value == ResultCodeLastAdmin {
+		writeError(w, 409, ErrorCodeLastAdmin, string(res.Data))
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(res.Data)
+}
+
+// expectation is the state of the key a write is conditional on.
+type expectation struct {
+	ver uint64
+	// mustExist is set when the key must exist, version 0 then matches any
+	// version of the key
+	mustExist bool
+	// conditional reports whether the expectation came from a conditional
+	// request header
+	conditional bool
+}
+
+// precondition returns the expected state of the key. The If-Match header
+// takes precedence over the ver parameter. A non-zero version requires the key
+// to exist, If-Match: * requires it to exist with any version.
+func (h *handler) precondition(w http.ResponseWriter, r *http.Request) (expectation, bool) {
+	if v := r.Header.Get("If-Match"); len(v) > 0 {
+		if strings.TrimSpace(v) == "*" {
+			return expectation{mustExist: true, conditional: true}, true
+		}
+		ver, ok := parseETag(v)
+		if !ok {
+			writeError(w, 400, ErrorCodeBadRequest, "If-Match must be * or a single ETag")
+			return expectation{}, false
+		}
+		return expectation{ver: ver, mustExist: ver != 0, conditional: true}, true
+	}
+	var ver uint64
+	if len(r.FormValue("ver")) > 0 {
+		var err error
+		if ver, err = strconv.ParseUint(r.FormValue("ver"), 10, 64); err != nil {
+			writeError(w, 400, ErrorCodeBadRequest, "Version must be uint64")
+			return expectation{}, false
+		}
+	}
+	return expectation{ver: ver, mustExist: ver != 0}, true
+}
+
+func (h *handler) versionMismatch(w http.ResponseWriter, exp expectation, res dbsm.Result) {
+	var result Entry
+	json.Unmarshal(res.Data, &result)
+	status, code := 409, ErrorCodeVersionMismatch
+	if exp.conditional {
+		status, code = 412, ErrorCodePreconditionFailed
+	}
+	msg := fmt.Sprintf("Version mismatch (%d != %d)", exp.ver, result.Ver)
+	if result.Ver == 0 {
+		// only writes requiring the key to exist are rejected for missing keys
+		msg = "Not Found"
 	} else {
-		w.WriteHeader(405)
-		w.Write([]byte("Method not supported"))
+		w.Header().Set("ETag", etag(result.Ver))
+	}
+	writeAPIError(w, status, apiError{
+		Code:    code,
+		Message: msg,
+		Version: result.Ver,
+	})
+}
+
+// etag returns the strong entity tag of an entry version.
+func etag(ver uint64) string {
+	return strconv.Quote(strconv.FormatUint(ver, 10))
+}
+
+// parseETag parses an entity tag produced by etag. Weak tags are accepted as
+// versions are unique per key.
+func parseETag(v string) (uint64, bool) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+	s, err := strconv.Unquote(v)
+	if err != nil {
+		return 0, false
 	}
+	ver, err := strconv.ParseUint(s, 10, 64)
+	return ver, err == nil
 }
@@ -0,0 +1,47 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewlineWriter(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{0, "", "\n"},
+		{0, "{}", "{}\n"},
+		{200, "{}", "{}\n"},
+		{404, "{}", "{}\n"},
+		{204, "", ""},
+		{304, "", ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		w := &newlineWriter{ResponseWriter: rec}
+		if tt.status != 0 {
+			w.WriteHeader(tt.status)
+		}
+		w.Write([]byte(tt.body))
+		w.writeNewline()
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("status %d: body %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
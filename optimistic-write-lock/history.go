@@ -0,0 +1,165 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	dbsm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// historyOptions bounds the prior versions kept per key. At most count
+// versions are kept, versions replaced more than age ago are dropped when age
+// is not 0. History is disabled when count is 0. All replicas must use the same
+// options.
+type historyOptions struct {
+	count int
+	age   time.Duration
+}
+
+// Revision is a prior version of a key. Replaced is the proposal time in Unix
+// nanoseconds of the command that replaced or deleted it.
+type Revision struct {
+	Entry
+	Replaced int64 `json:"replaced,omitempty"`
+}
+
+// HistoryQuery returns the current entry and the prior versions of Key.
+type HistoryQuery struct {
+	Key   string
+	Token string
+}
+
+// History lists the prior versions of a key newest first. Current is nil when
+// the key doesn't exist.
+type History struct {
+	Current  *Entry     `json:"current"`
+	Versions []Revision `json:"versions"`
+}
+
+// historyRef identifies a revision in the expiry queue.
+type historyRef struct {
+	key      string
+	ver      uint64
+	replaced int64
+}
+
+// tick advances the state machine clock to the proposal time of a command.
+// The clock never goes backwards so the expiry queue stays ordered when the
+// clocks of the proposers disagree.
+func (fsm *linearizableFSM) tick(t int64) {
+	if t > fsm.now {
+		fsm.now = t
+	}
+}
+
+// archive records entry as a prior version of its key.
+func (fsm *linearizableFSM) archive(entry Entry) {
+	if fsm.historyOpts.count <= 0 || isReserved(entry.Key) {
+		return
+	}
+	versions := append(fsm.store.revisions(entry.Key), Revision{Entry: entry, Replaced: fsm.now})
+	if len(versions) > fsm.historyOpts.count {
+		versions = versions[len(versions)-fsm.historyOpts.count:]
+	}
+	fsm.store.setRevisions(entry.Key, versions)
+	if fsm.historyOpts.age > 0 {
+		fsm.store.pushExpiry(historyRef{key: entry.Key, ver: entry.Ver, replaced: fsm.now})
+	}
+}
+
+// expire drops the versions replaced more than the configured age before the
+// state machine clock. It only depends on the applied commands and is thus
+// deterministic.
+func (fsm *linearizableFSM) expire() {
+	if fsm.historyOpts.age <= 0 {
+		return
+	}
+	for _, ref := range fsm.store.popExpired(fsm.now - int64(fsm.historyOpts.age)) {
+		// the version may already have been dropped by the count limit
+		versions := fsm.store.revisions(ref.key)
+		if len(versions) > 0 && versions[0].Ver == ref.ver {
+			fsm.store.setRevisions(ref.key, versions[1:])
+		}
+	}
+}
+
+// rebuildExpiry rebuilds the expiry queue after recovering from a snapshot.
+func (fsm *linearizableFSM) rebuildExpiry() {
+	if fsm.historyOpts.age <= 0 {
+		return
+	}
+	var refs []historyRef
+	fsm.store.scanHistory(func(key string, versions []Revision) bool {
+		for _, v := range versions {
+			refs = append(refs, historyRef{key: key, ver: v.Ver, replaced: v.Replaced})
+		}
+		return true
+	})
+	sort.Slice(refs, func(i, j int) bool {
+		a, b := refs[i], refs[j]
+		if a.replaced != b.replaced {
+			return a.replaced < b.replaced
+		}
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		return a.ver < b.ver
+	})
+	for _, ref := range refs {
+		fsm.store.pushExpiry(ref)
+	}
+}
+
+// version returns version ver of key, it is either the current entry or a
+// prior version.
+func (fsm *linearizableFSM) version(key string, ver uint64) (Entry, bool) {
+	if entry, ok := fsm.store.get(key); ok && entry.Ver == ver {
+		return entry, true
+	}
+	for _, v := range fsm.store.revisions(key) {
+		if v.Ver == ver {
+			return v.Entry, true
+		}
+	}
+	return Entry{}, false
+}
+
+func (fsm *linearizableFSM) keyHistory(query HistoryQuery) (History, error) {
+	if err := fsm.authorize(query.Token, false, query.Key); err != nil {
+		return History{}, err
+	}
+	h := History{Versions: []Revision{}}
+	if entry, ok := fsm.store.get(query.Key); ok {
+		h.Current = &entry
+	}
+	versions := fsm.store.revisions(query.Key)
+	for i := len(versions) - 1; i >= 0; i-- {
+		h.Versions = append(h.Versions, versions[i])
+	}
+	return h, nil
+}
+
+// revert sets the value of the key back to the value of version cmd.Revert.
+// Like a put it is rejected when the key's current version doesn't match the
+// version of the command.
+func (fsm *linearizableFSM) revert(cmd Command, index uint64) dbsm.Result {
+	old, ok := fsm.version(cmd.Key, cmd.Revert)
+	if !ok {
+		return dbsm.Result{Value: ResultCodeNotFound}
+	}
+	return fsm.put(Entry{Key: cmd.Key, Ver: cmd.Ver, Val: old.Val}, cmd.MustExist, index)
+}
@@ -0,0 +1,149 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// history returns the current entry and the prior versions of key.
+func (sm *testFSM) history(key string) History {
+	res, err := sm.lookup(HistoryQuery{Key: key})
+	if err != nil {
+		sm.t.Fatalf("failed to get the history of %q, %v", key, err)
+	}
+	return res.(History)
+}
+
+func historyVersions(h History) []uint64 {
+	vers := []uint64{}
+	for _, v := range h.Versions {
+		vers = append(vers, v.Ver)
+	}
+	return vers
+}
+
+func TestHistoryCountLimit(t *testing.T) {
+	forEachStore(t, historyOptions{count: 3}, func(t *testing.T, sm *testFSM) {
+		var ver uint64
+		for i := 1; i <= 5; i++ {
+			sm.mustPropose(Command{Entry: Entry{Key: "a", Ver: ver, Val: fmt.Sprint(i)}})
+			ver = sm.index
+		}
+		h := sm.history("a")
+		if h.Current == nil || h.Current.Ver != 5 || h.Current.Val != "5" {
+			t.Errorf("current is %+v, want version 5", h.Current)
+		}
+		if vers := historyVersions(h); !reflect.DeepEqual(vers, []uint64{4, 3, 2}) {
+			t.Errorf("history holds versions %v, want [4 3 2]", vers)
+		}
+		// dropped versions can't be read
+		for ver, ok := range map[uint64]bool{1: false, 2: true, 5: true} {
+			res, err := sm.lookup(Query{Key: "a", Ver: ver})
+			if err != nil {
+				t.Fatalf("failed to get version %d, %v", ver, err)
+			}
+			if entry, found := res.(Entry); found != ok || (ok && entry.Val != fmt.Sprint(ver)) {
+				t.Errorf("version %d is %v, want found %t", ver, res, ok)
+			}
+		}
+		// deleting a key archives its last version
+		sm.mustPropose(Command{Type: CommandTypeDelete, Entry: Entry{Key: "a"}})
+		h = sm.history("a")
+		if h.Current != nil {
+			t.Errorf("deleted key has current entry %+v", h.Current)
+		}
+		if vers := historyVersions(h); !reflect.DeepEqual(vers, []uint64{5, 4, 3}) {
+			t.Errorf("history holds versions %v, want [5 4 3]", vers)
+		}
+	})
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	forEachStore(t, historyOptions{}, func(t *testing.T, sm *testFSM) {
+		sm.mustPropose(Command{Entry: Entry{Key: "a", Val: "1"}})
+		sm.mustPropose(Command{Entry: Entry{Key: "a", Ver: 1, Val: "2"}})
+		if vers := historyVersions(sm.history("a")); len(vers) != 0 {
+			t.Errorf("history holds versions %v", vers)
+		}
+	})
+}
+
+func TestHistoryAgeLimit(t *testing.T) {
+	forEachStore(t, historyOptions{count: 10, age: time.Minute}, func(t *testing.T, sm *testFSM) {
+		start := time.Now().UnixNano()
+		at := func(d time.Duration) int64 { return start + int64(d) }
+		sm.mustPropose(Command{Entry: Entry{Key: "a", Val: "1"}, Time: at(0)})
+		sm.mustPropose(Command{Entry: Entry{Key: "a", Ver: 1, Val: "2"}, Time: at(time.Second)})
+		sm.mustPropose(Command{Entry: Entry{Key: "a", Ver: 2, Val: "3"}, Time: at(30 * time.Second)})
+		if vers := historyVersions(sm.history("a")); !reflect.DeepEqual(vers, []uint64{2, 1}) {
+			t.Errorf("history holds versions %v, want [2 1]", vers)
+		}
+		// any command advances the clock, version 1 was replaced more than a
+		// minute before
+		sm.mustPropose(Command{Entry: Entry{Key: "b", Val: "1"}, Time: at(time.Minute + 2*time.Second)})
+		if vers := historyVersions(sm.history("a")); !reflect.DeepEqual(vers, []uint64{2}) {
+			t.Errorf("history holds versions %v, want [2]", vers)
+		}
+		// the clock doesn't go backwards with commands of lagging proposers
+		sm.mustPropose(Command{Entry: Entry{Key: "b", Ver: 4, Val: "2"}, Time: at(0)})
+		sm.mustPropose(Command{Entry: Entry{Key: "c", Val: "1"}, Time: at(2 * time.Minute)})
+		if vers := historyVersions(sm.history("a")); len(vers) != 0 {
+			t.Errorf("history holds versions %v", vers)
+		}
+		if vers := historyVersions(sm.history("b")); !reflect.DeepEqual(vers, []uint64{4}) {
+			t.Errorf("history of b holds versions %v, want [4]", vers)
+		}
+	})
+}
+
+func TestRevert(t *testing.T) {
+	forEachStore(t, historyOptions{count: 2}, func(t *testing.T, sm *testFSM) {
+		sm.mustPropose(Command{Entry: Entry{Key: "a", Val: "1"}})
+		sm.mustPropose(Command{Entry: Entry{Key: "a", Ver: 1, Val: "2"}})
+		sm.mustPropose(Command{Entry: Entry{Key: "a", Ver: 2, Val: "3"}})
+		sm.mustPropose(Command{Entry: Entry{Key: "a", Ver: 3, Val: "4"}})
+		tests := []struct {
+			name   string
+			ver    uint64
+			revert uint64
+			code   uint64
+		}{
+			{"dropped version", 4, 1, ResultCodeNotFound},
+			{"unknown version", 4, 7, ResultCodeNotFound},
+			{"mismatched version", 3, 2, ResultCodeVersionMismatch},
+			// the rejected commands were entries 5 to 7
+			{"prior version", 4, 2, ResultCodeSuccess},
+			// the reverted value is a new version, the replaced one is kept
+			{"replaced version", 8, 4, ResultCodeSuccess},
+		}
+		for _, tt := range tests {
+			cmd := Command{Type: CommandTypeRevert, Entry: Entry{Key: "a", Ver: tt.ver}, Revert: tt.revert}
+			if res := sm.propose(cmd); res.Value != tt.code {
+				t.Errorf("%s: result %d, want %d, %s", tt.name, res.Value, tt.code, res.Data)
+			}
+		}
+		h := sm.history("a")
+		if h.Current == nil || h.Current.Ver != 9 || h.Current.Val != "4" {
+			t.Errorf("current is %+v, want 4 at version 9", h.Current)
+		}
+		if vers := historyVersions(h); !reflect.DeepEqual(vers, []uint64{8, 4}) {
+			t.Errorf("history holds versions %v, want [8 4]", vers)
+		}
+	})
+}
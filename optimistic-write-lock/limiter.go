@@ -0,0 +1,56 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// limiter bounds the number of requests a node serves concurrently. Requests
+// beyond the limit are shed right away rather than queued, so proposals don't
+// pile up inside NodeHost until they time out. A nil limiter admits all
+// requests.
+type limiter struct {
+	slots chan struct{}
+}
+
+// newLimiter returns a limiter admitting up to n concurrent requests, it
+// returns nil when n is not positive.
+func newLimiter(n int) *limiter {
+	if n <= 0 {
+		return nil
+	}
+	return &limiter{slots: make(chan struct{}, n)}
+}
+
+// acquire admits a request, release must be called once it completes.
+func (l *limiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		metrics.GetOrCreateCounter("optimistic_write_lock_shed_requests_total").Inc()
+		return false
+	}
+}
+
+func (l *limiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anishathalye/porcupine"
+)
+
+// kvInput is a GET or a PUT with an expected version of a key.
+type kvInput struct {
+	put bool
+	key string
+	ver uint64
+	val string
+}
+
+// kvOutput is the observed outcome of an operation. A GET of a missing key
+// returns version 0. A rejected PUT returns the current version of the key.
+type kvOutput struct {
+	ok  bool
+	ver uint64
+	val string
+}
+
+// kvState is the value of a single key, version 0 means the key doesn't
+// exist.
+type kvState struct {
+	ver uint64
+	val string
+}
+
+// kvModel is the sequential specification of the store, it is partitioned by
+// key.
+var kvModel = porcupine.Model{
+	Partition: func(history []porcupine.Operation) [][]porcupine.Operation {
+		byKey := map[string][]porcupine.Operation{}
+		var keys []string
+		for _, op := range history {
+			key := op.Input.(kvInput).key
+			if _, ok := byKey[key]; !ok {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], op)
+		}
+		var partitions [][]porcupine.Operation
+		for _, key := range keys {
+			partitions = append(partitions, byKey[key])
+		}
+		return partitions
+	},
+	Init: func() interface{} {
+		return kvState{}
+	},
+	Step: func(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+		s := state.(kvState)
+		in := input.(kvInput)
+		out := output.(kvOutput)
+		if !in.put {
+			return out.ver == s.ver && out.val == s.val, s
+		}
+		// puts of existing keys are version checked, missing keys can always be
+		// created
+		matches := s.ver == 0 || s.ver == in.ver
+		if out.ok {
+			return matches && out.ver > s.ver, kvState{ver: out.ver, val: in.val}
+		}
+		return !matches && out.ver == s.ver, s
+	},
+	DescribeOperation: func(input interface{}, output interface{}) string {
+		in := input.(kvInput)
+		out := output.(kvOutput)
+		if !in.put {
+			return fmt.Sprintf("get(%s) -> %d:%q", in.key, out.ver, out.val)
+		}
+		if out.ok {
+			return fmt.Sprintf("put(%s, %d, %q) -> %d", in.key, in.ver, in.val, out.ver)
+		}
+		return fmt.Sprintf("put(%s, %d, %q) -> mismatch %d", in.key, in.ver, in.val, out.ver)
+	},
+	DescribeState: func(state interface{}) string {
+		s := state.(kvState)
+		return fmt.Sprintf("%d:%q", s.ver, s.val)
+	},
+}
+
+// linearizabilityCluster is a three node cluster whose nodes can be killed
+// and restarted while clients send requests to it.
+type linearizabilityCluster struct {
+	mu    sync.Mutex
+	opts  []nodeOptions
+	nodes []*node
+}
+
+func (c *linearizabilityCluster) start(t *testing.T, i int) {
+	n, err := startNode(c.opts[i])
+	if err != nil {
+		t.Fatalf("failed to start node %d, %v", i+1, err)
+	}
+	c.mu.Lock()
+	c.nodes[i] = n
+	c.mu.Unlock()
+}
+
+// kill stops a node without draining its in-flight requests.
+func (c *linearizabilityCluster) kill(i int) {
+	c.mu.Lock()
+	n := c.nodes[i]
+	c.nodes[i] = nil
+	c.mu.Unlock()
+	n.hub.close()
+	n.router.close()
+	n.http.Close()
+	n.nh.Close()
+}
+
+func (c *linearizabilityCluster) stop() {
+	c.mu.Lock()
+	var running []*node
+	for _, n := range c.nodes {
+		if n != nil {
+			running = append(running, n)
+		}
+	}
+	c.mu.Unlock()
+	shutdown(running, time.Second)
+}
+
+// linearizabilityClient records the operations it makes in the history.
+type linearizabilityClient struct {
+	id     int
+	http   *http.Client
+	urls   []string
+	start  time.Time
+	record func(porcupine.Operation, bool)
+}
+
+func (c *linearizabilityClient) url(key string) string {
+	return c.urls[rand.Intn(len(c.urls))] + key
+}
+
+func (c *linearizabilityClient) get(key string) (uint64, bool) {
+	u := c.url(key)
+	// batched reads must be linearizable as well
+	if rand.Intn(2) == 0 {
+		u += "?consistency=batched"
+	}
+	call := time.Since(c.start).Nanoseconds()
+	resp, err := c.http.Get(u)
+	if err != nil {
+		return 0, false
+	}
+	defer resp.Body.Close()
+	var entry Entry
+	switch resp.StatusCode {
+	case 200:
+		if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+			return 0, false
+		}
+	case 404:
+	default:
+		// failed reads have no effect and are not recorded
+		return 0, false
+	}
+	c.record(porcupine.Operation{
+		ClientId: c.id,
+		Input:    kvInput{key: key},
+		Call:     call,
+		Output:   kvOutput{ver: entry.Ver, val: entry.Val},
+		Return:   time.Since(c.start).Nanoseconds(),
+	}, false)
+	return entry.Ver, true
+}
+
+func (c *linearizabilityClient) put(key string, ver uint64, val string) {
+	in := kvInput{put: true, key: key, ver: ver, val: val}
+	op := porcupine.Operation{ClientId: c.id, Input: in, Call: time.Since(c.start).Nanoseconds()}
+	req, _ := http.NewRequest("PUT",
+		fmt.Sprintf("%s?ver=%d&val=%s", c.url(key), ver, val), nil)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.record(op, true)
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		var entry Entry
+		if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+			c.record(op, true)
+			return
+		}
+		op.Output = kvOutput{ok: true, ver: entry.Ver}
+	case 409:
+		current, _ := parseETag(resp.Header.Get("ETag"))
+		op.Output = kvOutput{ver: current}
+	default:
+		// the put may or may not have been applied
+		c.record(op, true)
+		return
+	}
+	op.Return = time.Since(c.start).Nanoseconds()
+	c.record(op, false)
+}
+
+func TestLinearizability(t *testing.T) {
+	testLinearizability(t, StorageMemory)
+}
+
+func TestLinearizabilityOnDisk(t *testing.T) {
+	testLinearizability(t, StorageDisk)
+}
+
+func testLinearizability(t *testing.T, storage string) {
+	if testing.Short() {
+		t.Skip("skipping the linearizability test in short mode")
+	}
+	dir := t.TempDir()
+	addrs := freeAddrs(t, 6)
+	peers := make(map[uint64]peer)
+	for i := uint64(1); i <= 3; i++ {
+		peers[i] = peer{raftAddr: addrs[i-1], httpAddr: addrs[i+2]}
+	}
+	c := &linearizabilityCluster{nodes: make([]*node, 3)}
+	var urls []string
+	for i := uint64(1); i <= 3; i++ {
+		c.opts = append(c.opts, nodeOptions{
+			replicaID: i,
+			raftAddr:  peers[i].raftAddr,
+			httpAddr:  peers[i].httpAddr,
+			dir:       filepath.Join(dir, fmt.Sprintf("%d", i)),
+			peers:     peers,
+			// all versions are kept to resolve the outcome of failed puts
+			history: historyOptions{count: math.MaxInt32},
+			storage: storage,
+		})
+		urls = append(urls, "http://"+peers[i].httpAddr)
+	}
+	for i := range c.opts {
+		c.start(t, i)
+	}
+	defer c.stop()
+	httpClient := &http.Client{Timeout: 2 * time.Second}
+	waitForLeader(t, httpClient, urls[0])
+
+	var mu sync.Mutex
+	var history []porcupine.Operation
+	var pending []porcupine.Operation
+	record := func(op porcupine.Operation, unknown bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if unknown {
+			pending = append(pending, op)
+		} else {
+			history = append(history, op)
+		}
+	}
+	keys := []string{"/lin/a", "/lin/b", "/lin/c"}
+	start := time.Now()
+	duration := 8 * time.Second
+	var wg sync.WaitGroup
+	for id := 0; id < 6; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			client := &linearizabilityClient{id: id, http: httpClient, urls: urls, start: start, record: record}
+			for seq := 0; time.Since(start) < duration; seq++ {
+				key := keys[rand.Intn(len(keys))]
+				ver, ok := client.get(key)
+				if !ok {
+					time.Sleep(50 * time.Millisecond)
+					continue
+				}
+				// stale versions are used now and then to exercise the conflicts
+				if rand.Intn(5) == 0 && ver > 0 {
+					ver--
+				}
+				client.put(key, ver, fmt.Sprintf("c%d-%d", id, seq))
+			}
+		}(id)
+	}
+	// one node at a time is killed and restarted so the shard keeps a quorum
+	for time.Since(start) < duration-2*time.Second {
+		time.Sleep(time.Second)
+		i := rand.Intn(3)
+		c.kill(i)
+		time.Sleep(time.Second)
+		c.start(t, i)
+	}
+	wg.Wait()
+
+	history = append(history, resolvePending(t, httpClient, urls[0], keys, pending)...)
+	t.Logf("checking %d operations, %d had an unknown outcome", len(history), len(pending))
+	res, info := porcupine.CheckOperationsVerbose(kvModel, history, 30*time.Second)
+	switch res {
+	case porcupine.Ok:
+	case porcupine.Unknown:
+		// the history is partitioned by key, the check of a few thousand
+		// operations completes well within the timeout
+		t.Fatalf("linearizability check of %d operations timed out", len(history))
+	default:
+		f, err := os.CreateTemp("", "owl-linearizability-*.html")
+		if err != nil {
+			t.Fatalf("history is not linearizable, failed to write the visualization, %v", err)
+		}
+		defer f.Close()
+		if err := porcupine.Visualize(kvModel, info, f); err != nil {
+			t.Fatalf("history is not linearizable, failed to write the visualization, %v", err)
+		}
+		t.Fatalf("history is not linearizable, see %s", f.Name())
+	}
+}
+
+func waitForLeader(t testing.TB, client *http.Client, url string) {
+	for deadline := time.Now().Add(20 * time.Second); time.Now().Before(deadline); {
+		resp, err := client.Get(url + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == 200 {
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("no leader elected")
+}
+
+// startTestNode starts a single node shard and returns the node and the URL
+// of its HTTP API once the node is the leader.
+func startTestNode(t *testing.T) (*node, string) {
+	addrs := freeAddrs(t, 2)
+	n, err := startNode(nodeOptions{
+		replicaID: 1,
+		raftAddr:  addrs[0],
+		httpAddr:  addrs[1],
+		dir:       filepath.Join(t.TempDir(), "1"),
+		peers:     map[uint64]peer{1: {raftAddr: addrs[0], httpAddr: addrs[1]}},
+	})
+	if err != nil {
+		t.Fatalf("failed to start the node, %v", err)
+	}
+	t.Cleanup(func() { shutdown([]*node{n}, time.Second) })
+	url := "http://" + addrs[1]
+	waitForLeader(t, &http.Client{Timeout: 5 * time.Second}, url)
+	return n, url
+}
+
+// resolvePending resolves the outcome of the puts that failed without a
+// response using the version history. As values are unique, a put was applied
+// when its value is found in the history. Applied puts may have taken effect
+// any time after they were made, the others are dropped.
+func resolvePending(t *testing.T, client *http.Client, url string, keys []string, pending []porcupine.Operation) []porcupine.Operation {
+	versions := map[string]uint64{}
+	for _, key := range keys {
+		var h History
+		for deadline := time.Now().Add(20 * time.Second); ; {
+			resp, err := client.Get(url + key + "?history=true")
+			if err == nil {
+				err = json.NewDecoder(resp.Body).Decode(&h)
+				resp.Body.Close()
+				if err == nil && resp.StatusCode != 200 {
+					err = fmt.Errorf("status %d", resp.StatusCode)
+				}
+			}
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("failed to get the history of %s, %v", key, err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if h.Current != nil {
+			versions[key+"="+h.Current.Val] = h.Current.Ver
+		}
+		for _, v := range h.Versions {
+			versions[key+"="+v.Val] = v.Ver
+		}
+	}
+	var resolved []porcupine.Operation
+	for _, op := range pending {
+		in := op.Input.(kvInput)
+		if ver, ok := versions[in.key+"="+in.val]; ok {
+			op.Output = kvOutput{ok: true, ver: ver}
+			op.Return = math.MaxInt64
+			resolved = append(resolved, op)
+		}
+	}
+	return resolved
+}
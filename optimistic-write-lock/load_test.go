@@ -0,0 +1,93 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// BenchmarkReadConsistency measures the GET throughput of a three node
+// cluster for each read consistency level. Reads are sent concurrently to a
+// follower, run it with e.g.
+//
+//	go test -run NONE -bench ReadConsistency -cpu 64
+func BenchmarkReadConsistency(b *testing.B) {
+	dir := b.TempDir()
+	addrs := freeAddrs(b, 6)
+	peers := make(map[uint64]peer)
+	for i := uint64(1); i <= 3; i++ {
+		peers[i] = peer{raftAddr: addrs[i-1], httpAddr: addrs[i+2]}
+	}
+	var nodes []*node
+	defer func() {
+		shutdown(nodes, time.Second)
+	}()
+	for i := uint64(1); i <= 3; i++ {
+		n, err := startNode(nodeOptions{
+			replicaID: i,
+			raftAddr:  peers[i].raftAddr,
+			httpAddr:  peers[i].httpAddr,
+			dir:       filepath.Join(dir, fmt.Sprintf("%d", i)),
+			peers:     peers,
+		})
+		if err != nil {
+			b.Fatalf("failed to start node %d, %v", i, err)
+		}
+		nodes = append(nodes, n)
+	}
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: 1024},
+	}
+	waitForLeader(b, client, "http://"+peers[1].httpAddr)
+	leaderID, _, _, err := nodes[0].nh.GetLeaderID(shardID)
+	if err != nil {
+		b.Fatalf("failed to get the leader, %v", err)
+	}
+	follower := "http://" + peers[leaderID%3+1].httpAddr
+	req, _ := http.NewRequest("PUT", follower+"/bench?val=v", nil)
+	if resp, err := client.Do(req); err != nil || resp.StatusCode != 200 {
+		b.Fatalf("failed to put the benchmark key, %v", err)
+	}
+
+	for _, consistency := range []string{ConsistencyLinearizable, ConsistencyBatched, ConsistencyStale} {
+		b.Run(consistency, func(b *testing.B) {
+			url := follower + "/bench?consistency=" + consistency
+			start := time.Now()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					resp, err := client.Get(url)
+					if err != nil {
+						b.Errorf("read failed, %v", err)
+						return
+					}
+					io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode != 200 {
+						b.Errorf("read failed with status %d", resp.StatusCode)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "reads/s")
+		})
+	}
+}
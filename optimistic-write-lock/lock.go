@@ -0,0 +1,179 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	dbsm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+const (
+	// lockPrefix is the reserved key space holding the lock leases, the lease
+	// of a lock named /name is stored as the JSON encoded value of
+	// /_locks/name.
+	lockPrefix = "/_locks/"
+	maxLockTTL = time.Hour
+	// maxLockSkew is how far the clock of a leader proposing a lock command
+	// may lag behind the lock clock, which holds the latest time proposed by
+	// any leader. Lock commands further behind are rejected, so the clocks of
+	// all nodes must be synchronized within maxLockSkew.
+	maxLockSkew = time.Second
+)
+
+// Lock is the lease of a held lock. Token is the index of the entry that
+// acquired the lock, it increases with each acquisition and serves as the
+// fencing token of the holder. Expires is the time in Unix nanoseconds on the
+// lock clock at which the lease expires unless it is renewed.
+type Lock struct {
+	Name    string `json:"name"`
+	Owner   string `json:"owner"`
+	Token   uint64 `json:"token"`
+	TTL     int64  `json:"ttl"`
+	Expires int64  `json:"expires"`
+}
+
+// LockQuery returns the lease of the lock Name, nil when the lock is free.
+type LockQuery struct {
+	Name  string
+	Token string
+}
+
+func lockKey(name string) string {
+	return strings.TrimSuffix(lockPrefix, "/") + name
+}
+
+func validateLockName(name string) error {
+	if !strings.HasPrefix(name, "/") {
+		return fmt.Errorf("Lock name %q must start with /", name)
+	}
+	return validateKey(name)
+}
+
+func validateLockOwner(owner string) error {
+	if len(owner) == 0 {
+		return fmt.Errorf("Missing lock owner")
+	}
+	return validateValue(owner)
+}
+
+func validateTTL(ttl int64) error {
+	if ttl <= 0 || ttl > int64(maxLockTTL) {
+		return fmt.Errorf("TTL must be between 0 and %s", maxLockTTL)
+	}
+	return nil
+}
+
+// tickLock advances the lock clock, it returns false when t is more than
+// maxLockSkew behind it. Leases are only checked against the times proposed by
+// lock commands, which are proposed by the leader, so the clocks of followers
+// proposing other commands can't expire leases early. The times of a lagging
+// leader within the skew limit are clamped to the lock clock, the clock never
+// goes backwards.
+func (fsm *linearizableFSM) tickLock(t int64) bool {
+	if t < fsm.lockClock-int64(maxLockSkew) {
+		return false
+	}
+	if t > fsm.lockClock {
+		fsm.lockClock = t
+	}
+	return true
+}
+
+// heldLock returns the unexpired lease of the lock name.
+func (fsm *linearizableFSM) heldLock(name string) (Lock, bool) {
+	entry, ok := fsm.store.get(lockKey(name))
+	if !ok {
+		return Lock{}, false
+	}
+	var l Lock
+	if err := json.Unmarshal([]byte(entry.Val), &l); err != nil || l.Expires <= fsm.lockClock {
+		return Lock{}, false
+	}
+	return l, true
+}
+
+// acquire grants the lock to the owner in the value of cmd unless it is held.
+func (fsm *linearizableFSM) acquire(cmd Command, index uint64) dbsm.Result {
+	if !fsm.tickLock(cmd.Time) {
+		return dbsm.Result{Value: ResultCodeClockSkew}
+	}
+	if held, ok := fsm.heldLock(cmd.Key); ok {
+		data, _ := json.Marshal(held)
+		return dbsm.Result{Value: ResultCodeLocked, Data: data}
+	}
+	l := Lock{
+		Name:    cmd.Key,
+		Owner:   cmd.Val,
+		Token:   index,
+		TTL:     cmd.TTL,
+		Expires: fsm.lockClock + cmd.TTL,
+	}
+	return fsm.setLock(l, index)
+}
+
+// renew extends the lease held by the owner in the value of cmd with the
+// token in its version, by its TTL or by the TTL of cmd when set.
+func (fsm *linearizableFSM) renew(cmd Command, index uint64) dbsm.Result {
+	if !fsm.tickLock(cmd.Time) {
+		return dbsm.Result{Value: ResultCodeClockSkew}
+	}
+	held, ok := fsm.heldLock(cmd.Key)
+	if !ok || held.Token != cmd.Ver || held.Owner != cmd.Val {
+		return dbsm.Result{Value: ResultCodeLockLost}
+	}
+	if cmd.TTL != 0 {
+		held.TTL = cmd.TTL
+	}
+	held.Expires = fsm.lockClock + held.TTL
+	return fsm.setLock(held, index)
+}
+
+// release frees the lock when it is held by the owner in the value of cmd
+// with the token in its version.
+func (fsm *linearizableFSM) release(cmd Command) dbsm.Result {
+	if !fsm.tickLock(cmd.Time) {
+		return dbsm.Result{Value: ResultCodeClockSkew}
+	}
+	held, ok := fsm.heldLock(cmd.Key)
+	if !ok || held.Token != cmd.Ver || held.Owner != cmd.Val {
+		return dbsm.Result{Value: ResultCodeLockLost}
+	}
+	fsm.remove(lockKey(cmd.Key))
+	data, _ := json.Marshal(held)
+	return dbsm.Result{Value: ResultCodeSuccess, Data: data}
+}
+
+func (fsm *linearizableFSM) setLock(l Lock, index uint64) dbsm.Result {
+	data, _ := json.Marshal(l)
+	fsm.set(Entry{Key: lockKey(l.Name), Ver: index, Val: string(data)})
+	return dbsm.Result{Value: ResultCodeSuccess, Data: data}
+}
+
+// lock returns the lease of a held lock. The lock clock only advances with
+// lock commands, so a lease that expired since the last one is still
+// reported, clients compare Expires with their own clock.
+func (fsm *linearizableFSM) lock(query LockQuery) (interface{}, error) {
+	if err := fsm.authorize(query.Token, false, query.Name); err != nil {
+		return nil, err
+	}
+	if l, ok := fsm.heldLock(query.Name); ok {
+		return l, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockOwner(t *testing.T) {
+	forEachStore(t, historyOptions{}, func(t *testing.T, sm *testFSM) {
+		start := time.Now().UnixNano()
+		ttl := int64(10 * time.Second)
+		sm.mustPropose(Command{Type: CommandTypeLock, Entry: Entry{Key: "/l", Val: "a"}, TTL: ttl, Time: start})
+		token := sm.index
+		if res := sm.propose(Command{Type: CommandTypeLock, Entry: Entry{Key: "/m"}, TTL: ttl, Time: start}); res.Value != ResultCodeFailure {
+			t.Errorf("lock without owner: result %d, want %d", res.Value, ResultCodeFailure)
+		}
+		tests := []struct {
+			name  string
+			typ   string
+			owner string
+			token uint64
+			code  uint64
+		}{
+			{"renew without owner", CommandTypeRenew, "", token, ResultCodeFailure},
+			{"release without owner", CommandTypeUnlock, "", token, ResultCodeFailure},
+			{"renew by another owner", CommandTypeRenew, "b", token, ResultCodeLockLost},
+			{"release by another owner", CommandTypeUnlock, "b", token, ResultCodeLockLost},
+			{"renew with another token", CommandTypeRenew, "a", token + 1, ResultCodeLockLost},
+			{"renew", CommandTypeRenew, "a", token, ResultCodeSuccess},
+			{"release", CommandTypeUnlock, "a", token, ResultCodeSuccess},
+			{"release twice", CommandTypeUnlock, "a", token, ResultCodeLockLost},
+		}
+		for _, tt := range tests {
+			cmd := Command{Type: tt.typ, Entry: Entry{Key: "/l", Ver: tt.token, Val: tt.owner}, Time: start}
+			if res := sm.propose(cmd); res.Value != tt.code {
+				t.Errorf("%s: result %d, want %d", tt.name, res.Value, tt.code)
+			}
+		}
+	})
+}
+
+func TestLockClockSkew(t *testing.T) {
+	forEachStore(t, historyOptions{}, func(t *testing.T, sm *testFSM) {
+		start := time.Now().UnixNano()
+		at := func(d time.Duration) int64 { return start + int64(d) }
+		ttl := int64(10 * time.Second)
+		lock := func(name string, d time.Duration) uint64 {
+			cmd := Command{Type: CommandTypeLock, Entry: Entry{Key: name, Val: "a"}, TTL: ttl, Time: at(d)}
+			return sm.propose(cmd).Value
+		}
+		if code := lock("/a", 0); code != ResultCodeSuccess {
+			t.Fatalf("lock returned %d", code)
+		}
+		token := sm.index
+		// a lagging leader within the skew limit is clamped to the lock clock
+		if code := lock("/b", -maxLockSkew/2); code != ResultCodeSuccess {
+			t.Fatalf("lock within the skew limit returned %d", code)
+		}
+		if l, ok := sm.fsm.heldLock("/b"); !ok || l.Expires != at(0)+ttl {
+			t.Errorf("lease is %+v, want expiry at %d", l, at(0)+ttl)
+		}
+		// commands further behind are rejected and don't change the leases
+		if code := lock("/c", -2*maxLockSkew); code != ResultCodeClockSkew {
+			t.Errorf("lock behind the skew limit returned %d", code)
+		}
+		renew := Command{Type: CommandTypeRenew, Entry: Entry{Key: "/a", Ver: token, Val: "a"}, Time: at(-2 * maxLockSkew)}
+		if res := sm.propose(renew); res.Value != ResultCodeClockSkew {
+			t.Errorf("renew behind the skew limit returned %d", res.Value)
+		}
+		if _, ok := sm.fsm.heldLock("/c"); ok {
+			t.Errorf("rejected lock was acquired")
+		}
+		if l, _ := sm.fsm.heldLock("/a"); l.Expires != at(0)+ttl {
+			t.Errorf("rejected renew moved the expiry to %d", l.Expires)
+		}
+		// the lease expires once a later lock command advances the clock
+		if code := lock("/a", 11*time.Second); code != ResultCodeSuccess {
+			t.Errorf("lock of an expired lease returned %d", code)
+		}
+	})
+}
@@ -0,0 +1,208 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	dbsm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// lock serves the lock endpoints, the path of a lock is its name under
+// /_locks. Locks are acquired with POST, renewed with PUT and released with
+// DELETE, GET returns the current lease. The lock commands carry the time of
+// the leader proposing them, they are rejected by followers and by the state
+// machine when the clock of the leader lags more than maxLockSkew behind.
+func (h *handler) lock(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(lockPrefix, "/"))
+	if err := validateLockName(name); err != nil {
+		writeError(w, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	switch r.Method {
+	case "GET":
+		h.getLock(ctx, w, r, name)
+	case "POST":
+		h.acquireLock(ctx, w, r, name)
+	case "PUT", "DELETE":
+		h.renewLock(ctx, w, r, name)
+	default:
+		writeError(w, 405, ErrorCodeMethodNotAllowed, "Method not supported")
+	}
+}
+
+func (h *handler) getLock(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	if !h.limiter.acquire() {
+		writeOverloaded(w)
+		return
+	}
+	defer h.limiter.release()
+	res, err := h.read(ctx, r, LockQuery{Name: name, Token: token(r)})
+	if err != nil {
+		h.readError(w, err)
+		return
+	}
+	l, ok := res.(Lock)
+	if !ok {
+		writeError(w, 404, ErrorCodeNotFound, "Not Found")
+		return
+	}
+	b, _ := json.Marshal(l)
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+// acquireLock acquires a lock for the owner parameter with the ttl parameter
+// as the lease duration. With wait=true it waits for the lock to be released
+// or to expire until the request times out.
+func (h *handler) acquireLock(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	if err := validateLockOwner(r.FormValue("owner")); err != nil {
+		writeError(w, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	ttl, err := time.ParseDuration(r.FormValue("ttl"))
+	if err != nil || validateTTL(int64(ttl)) != nil {
+		writeError(w, 400, ErrorCodeBadRequest,
+			fmt.Sprintf("TTL must be a duration between 0 and %s, e.g. 10s", maxLockTTL))
+		return
+	}
+	cmd := Command{
+		Type:  CommandTypeLock,
+		Entry: Entry{Key: name, Val: r.FormValue("owner")},
+		TTL:   int64(ttl),
+		Token: token(r),
+	}
+	for {
+		// taken before proposing so a release applied in the meantime is seen
+		changed := h.index.next()
+		res, ok := h.proposeLock(ctx, w, cmd)
+		if !ok {
+			return
+		}
+		if res.Value == ResultCodeSuccess {
+			w.WriteHeader(200)
+			w.Write(res.Data)
+			return
+		}
+		var held Lock
+		json.Unmarshal(res.Data, &held)
+		if !isWaitRequest(r) || !h.waitForLock(ctx, r, held, changed) {
+			writeAPIError(w, 409, apiError{
+				Code:    ErrorCodeLocked,
+				Message: fmt.Sprintf("Lock %s is held by %q", name, held.Owner),
+				Lock:    &held,
+			})
+			return
+		}
+	}
+}
+
+// waitForLock waits until the lease may have been released or expired, it
+// returns false when ctx is done first.
+func (h *handler) waitForLock(ctx context.Context, r *http.Request, held Lock, changed <-chan struct{}) bool {
+	// the lease expires on the clock of the leader, which is the local clock
+	timer := time.NewTimer(time.Until(time.Unix(0, held.Expires)))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-ctx.Done():
+			return false
+		case <-changed:
+			changed = h.index.next()
+			res, err := h.nh.StaleRead(h.shardID, LockQuery{Name: held.Name, Token: token(r)})
+			if err != nil {
+				return true
+			}
+			if l, ok := res.(Lock); !ok || l.Token != held.Token {
+				return true
+			}
+		}
+	}
+}
+
+// renewLock renews the lease held by the owner parameter with the token
+// parameter on PUT, optionally with a new ttl, and releases it on DELETE.
+func (h *handler) renewLock(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) {
+	if err := validateLockOwner(r.FormValue("owner")); err != nil {
+		writeError(w, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	fencingToken, err := strconv.ParseUint(r.FormValue("token"), 10, 64)
+	if err != nil || fencingToken == 0 {
+		writeError(w, 400, ErrorCodeBadRequest, "Token must be a positive uint64")
+		return
+	}
+	cmd := Command{
+		Type:  CommandTypeUnlock,
+		Entry: Entry{Key: name, Ver: fencingToken, Val: r.FormValue("owner")},
+		Token: token(r),
+	}
+	if r.Method == "PUT" {
+		cmd.Type = CommandTypeRenew
+		if v := r.FormValue("ttl"); len(v) > 0 {
+			ttl, err := time.ParseDuration(v)
+			if err != nil || validateTTL(int64(ttl)) != nil {
+				writeError(w, 400, ErrorCodeBadRequest,
+					fmt.Sprintf("TTL must be a duration between 0 and %s, e.g. 10s", maxLockTTL))
+				return
+			}
+			cmd.TTL = int64(ttl)
+		}
+	}
+	res, ok := h.proposeLock(ctx, w, cmd)
+	if !ok {
+		return
+	}
+	if res.Value == ResultCodeLockLost {
+		writeError(w, 409, ErrorCodeLockLost,
+			fmt.Sprintf("Lock %s is not held by %q with token %d", name, cmd.Val, fencingToken))
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(res.Data)
+}
+
+// proposeLock proposes a lock command while holding a slot of the limiter,
+// lock commands are only proposed by the leader so leases expire on a single
+// clock.
+func (h *handler) proposeLock(ctx context.Context, w http.ResponseWriter, cmd Command) (dbsm.Result, bool) {
+	leaderID, _, valid, err := h.nh.GetLeaderID(h.shardID)
+	if err != nil || !valid || leaderID != h.replicaID {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, 503, ErrorCodeNotLeader, "Lock requests must be sent to the leader")
+		return dbsm.Result{}, false
+	}
+	if !h.limiter.acquire() {
+		writeOverloaded(w)
+		return dbsm.Result{}, false
+	}
+	defer h.limiter.release()
+	res, ok := h.propose(ctx, w, cmd)
+	if ok && res.Value == ResultCodeClockSkew {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, 503, ErrorCodeClockSkew,
+			fmt.Sprintf("The clock of the leader is more than %s behind the lock clock", maxLockSkew))
+		return res, false
+	}
+	return res, ok
+}
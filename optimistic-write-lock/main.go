@@ -18,19 +18,30 @@ linearizable is an example program for building a linearizable state machine usi
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/lni/dragonboat/v4"
 	"github.com/lni/dragonboat/v4/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/lni/dragonboat-example/v3/optimistic-write-lock/kvpb"
 )
 
 var (
-	datadir = "/tmp/dragonboat-example-linearizable"
 	members = map[uint64]string{
 		1: "localhost:61001",
 		2: "localhost:61002",
@@ -41,46 +52,421 @@ var (
 		":8002",
 		":8003",
 	}
+	grpcAddr = []string{
+		":9001",
+		":9002",
+		":9003",
+	}
 	shardID uint64 = 128
 )
 
-func main() {
-	stop := make(chan os.Signal)
-	signal.Notify(stop, os.Interrupt)
-	signal.Notify(stop, syscall.SIGTERM)
-	for i, nodeAddr := range members {
-		dir := fmt.Sprintf("%s/%d", datadir, i)
-		if err := os.MkdirAll(dir, 0777); err != nil {
-			panic(err)
+// peer is a replica of the shard and the addresses of its NodeHost.
+type peer struct {
+	raftAddr string
+	httpAddr string
+	grpcAddr string
+}
+
+// defaultPeers returns the hard coded members used by the all-in-one mode.
+func defaultPeers() map[uint64]peer {
+	peers := make(map[uint64]peer)
+	for i, addr := range members {
+		peers[i] = peer{raftAddr: addr, httpAddr: httpAddr[i-1], grpcAddr: grpcAddr[i-1]}
+	}
+	return peers
+}
+
+// parsePeers parses a comma separated list of peers in the
+// <replicaID>=<raft-addr>[=<http-addr>[=<grpc-addr>]] format, e.g.
+// 1=host1:61001=host1:8001,2=host2:61001=host2:8001=host2:9001
+func parsePeers(v string) (map[uint64]peer, error) {
+	peers := make(map[uint64]peer)
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); len(s) == 0 {
+			continue
+		}
+		parts := strings.SplitN(s, "=", 4)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid peer %q", s)
+		}
+		replicaID, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil || replicaID == 0 {
+			return nil, fmt.Errorf("invalid replica ID in peer %q", s)
+		}
+		p := peer{raftAddr: parts[1]}
+		if len(parts) >= 3 {
+			p.httpAddr = parts[2]
+		}
+		if len(parts) == 4 {
+			p.grpcAddr = parts[3]
+		}
+		peers[replicaID] = p
+	}
+	return peers, nil
+}
+
+// nodeOptions is the configuration of a single NodeHost and its servers. The
+// gRPC server is only started when grpcAddr is set.
+type nodeOptions struct {
+	replicaID uint64
+	raftAddr  string
+	httpAddr  string
+	grpcAddr  string
+	dir       string
+	join      bool
+	// replicaType is the role of a joining replica
+	replicaType string
+	forward     string
+	// forwardSecret marks the requests proxied between the nodes
+	forwardSecret string
+	peers         map[uint64]peer
+	tls           tlsOptions
+	history       historyOptions
+	// storage selects the in memory or the on disk state machine
+	storage string
+	// maxInflight bounds the requests served concurrently, 0 disables the
+	// limit
+	maxInflight int
+}
+
+// node is a running NodeHost and the servers serving requests on it.
+type node struct {
+	nh   *dragonboat.NodeHost
+	http *http.Server
+	grpc *grpc.Server
+	hub  *watchHub
+	// router serves the namespaces of the node
+	router *namespaceRouter
+}
+
+// startNode starts a NodeHost with a replica of the shard and the servers
+// serving requests on it.
+func startNode(opts nodeOptions) (*node, error) {
+	if err := os.MkdirAll(opts.dir, 0777); err != nil {
+		return nil, err
+	}
+	log.Printf("Starting node %s", opts.raftAddr)
+	transport, err := opts.tls.httpTransport()
+	if err != nil {
+		return nil, err
+	}
+	nh, err := dragonboat.NewNodeHost(nodeHostConfig(opts))
+	if err != nil {
+		return nil, err
+	}
+	urls := make(map[uint64]string)
+	for id, p := range opts.peers {
+		if len(p.httpAddr) > 0 {
+			urls[id] = httpURL(p.httpAddr, opts.tls.httpTLS())
+		}
+	}
+	hub := newWatchHub()
+	index := newAppliedIndex()
+	if err := startReplica(nh, shardID, opts, hub, index, nil); err != nil {
+		nh.Close()
+		return nil, err
+	}
+	n := &node{nh: nh, hub: hub}
+	lim := newLimiter(opts.maxInflight)
+	if len(opts.grpcAddr) > 0 {
+		if n.grpc, err = startGRPC(nh, hub, lim, opts); err != nil {
+			nh.Close()
+			return nil, err
+		}
+	}
+	fwd := newForwarder(opts.forward, urls, transport, opts.forwardSecret)
+	h := newHandler(nh, shardID, opts.replicaID, fwd, lim, index, hub)
+	h.exportDir = opts.exportDir(shardID)
+	n.router = newNamespaceRouter(nh, opts, fwd, lim)
+	h.router = n.router
+	go n.router.run(index)
+	s := &http.Server{
+		Addr:    opts.httpAddr,
+		Handler: h,
+	}
+	go func() {
+		var err error
+		if opts.tls.httpTLS() {
+			err = s.ListenAndServeTLS(opts.tls.httpCertFile, opts.tls.httpKeyFile)
+		} else {
+			err = s.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	n.http = s
+	return n, nil
+}
+
+// nodeHostConfig returns the NodeHost configuration of a node.
+func nodeHostConfig(opts nodeOptions) config.NodeHostConfig {
+	return config.NodeHostConfig{
+		RaftAddress:    opts.raftAddr,
+		NodeHostDir:    opts.dir,
+		RTTMillisecond: 100,
+		MutualTLS:      opts.tls.mutualTLS(),
+		CAFile:         opts.tls.caFile,
+		CertFile:       opts.tls.certFile,
+		KeyFile:        opts.tls.keyFile,
+	}
+}
+
+// startReplica starts the replica of the node in a shard, the changes applied
+// by the replica are published to hub and its applied index to index.
+func startReplica(nh *dragonboat.NodeHost, shardID uint64, opts nodeOptions,
+	hub *watchHub, index *appliedIndex, owner *Principal) error {
+	// a joining replica starts with no initial members, it learns the
+	// membership from the existing replicas once it has been added to the shard.
+	// Restarted replicas use their recorded membership, replicas imported from
+	// a snapshot are recorded as joined and reject initial members.
+	initialMembers := make(map[uint64]string)
+	if !opts.join && !nh.HasNodeInfo(shardID, opts.replicaID) {
+		for id, p := range opts.peers {
+			initialMembers[id] = p.raftAddr
 		}
-		log.Printf("Starting node %s", nodeAddr)
-		nh, err := dragonboat.NewNodeHost(config.NodeHostConfig{
-			RaftAddress:    nodeAddr,
-			NodeHostDir:    dir,
-			RTTMillisecond: 100,
-		})
+	}
+	rc := config.Config{
+		ReplicaID:          opts.replicaID,
+		ShardID:            shardID,
+		ElectionRTT:        10,
+		HeartbeatRTT:       1,
+		CheckQuorum:        true,
+		SnapshotEntries:    10,
+		CompactionOverhead: 5,
+		// membership changes are rejected when based on an outdated membership
+		OrderedConfigChange: true,
+		IsNonVoting:         opts.replicaType == ReplicaTypeNonVoting,
+		IsWitness:           opts.replicaType == ReplicaTypeWitness,
+	}
+	if rc.IsWitness {
+		// witnesses don't have a state machine to capture in snapshots
+		rc.SnapshotEntries = 0
+	}
+	if opts.storage == StorageDisk {
+		fsm := NewOnDiskFSM(opts.fsmDir(), hub, index, opts.history, owner)
+		return nh.StartOnDiskReplica(initialMembers, opts.join, fsm, rc)
+	}
+	fsm := NewLinearizableFSM(hub, index, opts.history, owner)
+	return nh.StartConcurrentReplica(initialMembers, opts.join, fsm, rc)
+}
+
+// startGRPC starts the gRPC server of a node, it uses the certificate of the
+// HTTP API when set.
+func startGRPC(nh *dragonboat.NodeHost, hub *watchHub, lim *limiter, opts nodeOptions) (*grpc.Server, error) {
+	var serverOpts []grpc.ServerOption
+	if opts.tls.httpTLS() {
+		creds, err := credentials.NewServerTLSFromFile(opts.tls.httpCertFile, opts.tls.httpKeyFile)
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		serverOpts = append(serverOpts, grpc.Creds(creds))
+	}
+	l, err := net.Listen("tcp", opts.grpcAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := grpc.NewServer(serverOpts...)
+	kvpb.RegisterKVServer(s, newGRPCServer(nh, hub, lim))
+	go func() {
+		if err := s.Serve(l); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return s, nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gencerts" {
+		genCertsMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		importMain(os.Args[2:])
+		return
+	}
+	forward := flag.String("forward", ForwardModeNone,
+		"Send requests received by followers to the leader, proxy or redirect")
+	forwardSecret := flag.String("forward-secret", "",
+		"Secret marking the requests proxied to the leader, must be the same on all nodes started as separate processes")
+	replicaID := flag.Uint64("replicaid", 0,
+		"ReplicaID of the node to start, all nodes are started in this process when 0")
+	raftAddr := flag.String("raft-addr", "",
+		"Raft address of the node, defaults to its address in peers")
+	httpAddrFlag := flag.String("http-addr", "",
+		"HTTP listen address of the node, defaults to its address in peers")
+	grpcAddrFlag := flag.String("grpc-addr", "",
+		"gRPC listen address of the node, defaults to its address in peers")
+	peersFlag := flag.String("peers", "",
+		"Comma separated <replicaID>=<raft-addr>[=<http-addr>[=<grpc-addr>]] list of the shard's replicas")
+	join := flag.Bool("join", false, "Join the node to an existing shard")
+	nonVoting := flag.Bool("nonvoting", false, "Join the node as a non-voting replica")
+	witness := flag.Bool("witness", false, "Join the node as a witness replica")
+	maxInflight := flag.Int("max-inflight", 1024,
+		"Requests a node serves concurrently before shedding load, 0 disables the limit")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second,
+		"How long to wait for in-flight requests on shutdown")
+	historyCount := flag.Int("history-count", 10,
+		"Number of prior versions kept per key, must be the same on all nodes")
+	historyAge := flag.Duration("history-age", 0,
+		"How long prior versions are kept after being replaced, 0 keeps them, must be the same on all nodes")
+	storage := flag.String("storage", StorageMemory,
+		"State machine storage, memory or disk, it can't be changed once the node has data")
+	datadir := flag.String("datadir", "/tmp/dragonboat-example-linearizable",
+		"Directory the node data is stored in")
+	var tlsOpts tlsOptions
+	tlsOpts.registerFlags(flag.CommandLine)
+	flag.Parse()
+	if err := tlsOpts.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if *historyCount < 0 || *historyAge < 0 {
+		fmt.Fprintf(os.Stderr, "-history-count and -history-age must not be negative\n")
+		os.Exit(1)
+	}
+	if *storage != StorageMemory && *storage != StorageDisk {
+		fmt.Fprintf(os.Stderr, "invalid storage %q\n", *storage)
+		os.Exit(1)
+	}
+	if *forward != ForwardModeNone && *forward != ForwardModeProxy && *forward != ForwardModeRedirect {
+		fmt.Fprintf(os.Stderr, "invalid forward mode %q\n", *forward)
+		os.Exit(1)
+	}
+	peers := defaultPeers()
+	if len(*peersFlag) > 0 {
+		var err error
+		if peers, err = parsePeers(*peersFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	var nodes []nodeOptions
+	if *replicaID == 0 {
+		if *join {
+			fmt.Fprintf(os.Stderr, "-join requires -replicaid\n")
+			os.Exit(1)
+		}
+		ids := make([]uint64, 0, len(peers))
+		for id := range peers {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			nodes = append(nodes, nodeOptions{
+				replicaID: id,
+				raftAddr:  peers[id].raftAddr,
+				httpAddr:  peers[id].httpAddr,
+				grpcAddr:  peers[id].grpcAddr,
+			})
+		}
+	} else {
+		if (*nonVoting || *witness) && !*join {
+			fmt.Fprintf(os.Stderr, "-nonvoting and -witness require -join\n")
+			os.Exit(1)
+		}
+		if *nonVoting && *witness {
+			fmt.Fprintf(os.Stderr, "-nonvoting and -witness can't be used together\n")
+			os.Exit(1)
 		}
-		fsm := NewLinearizableFSM()
-		err = nh.StartConcurrentReplica(members, false, fsm, config.Config{
-			ReplicaID:          uint64(i),
-			ShardID:            shardID,
-			ElectionRTT:        10,
-			HeartbeatRTT:       1,
-			CheckQuorum:        true,
-			SnapshotEntries:    10,
-			CompactionOverhead: 5,
-		})
+		n := nodeOptions{
+			replicaID:   *replicaID,
+			raftAddr:    *raftAddr,
+			httpAddr:    *httpAddrFlag,
+			grpcAddr:    *grpcAddrFlag,
+			join:        *join,
+			replicaType: ReplicaTypeVoting,
+		}
+		if *nonVoting {
+			n.replicaType = ReplicaTypeNonVoting
+		} else if *witness {
+			n.replicaType = ReplicaTypeWitness
+		}
+		if p, ok := peers[*replicaID]; ok {
+			if len(n.raftAddr) == 0 {
+				n.raftAddr = p.raftAddr
+			}
+			if len(n.httpAddr) == 0 {
+				n.httpAddr = p.httpAddr
+			}
+			if len(n.grpcAddr) == 0 {
+				n.grpcAddr = p.grpcAddr
+			}
+		} else if !*join {
+			fmt.Fprintf(os.Stderr, "replica %d is not in peers, use -join to add a new node\n", *replicaID)
+			os.Exit(1)
+		}
+		if len(n.raftAddr) == 0 || len(n.httpAddr) == 0 {
+			fmt.Fprintf(os.Stderr, "-raft-addr and -http-addr are required for nodes not in peers\n")
+			os.Exit(1)
+		}
+		nodes = append(nodes, n)
+	}
+	if len(*forwardSecret) == 0 {
+		// shared by the nodes started in this process
+		*forwardSecret = randomSecret()
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	signal.Notify(stop, syscall.SIGTERM)
+	var running []*node
+	for _, n := range nodes {
+		n.dir = fmt.Sprintf("%s/%d", *datadir, n.replicaID)
+		n.forward = *forward
+		n.forwardSecret = *forwardSecret
+		n.peers = peers
+		n.tls = tlsOpts
+		n.history = historyOptions{count: *historyCount, age: *historyAge}
+		n.storage = *storage
+		n.maxInflight = *maxInflight
+		rn, err := startNode(n)
 		if err != nil {
 			panic(err)
 		}
-		go func(s *http.Server) {
-			log.Fatal(s.ListenAndServe())
-		}(&http.Server{
-			Addr:    httpAddr[i-1],
-			Handler: &handler{nh},
-		})
+		running = append(running, rn)
 	}
 	<-stop
+	log.Printf("Shutting down")
+	shutdown(running, *drainTimeout)
+}
+
+// shutdown stops accepting new requests and waits up to timeout for the
+// in-flight ones to complete before closing the NodeHosts. All servers are
+// drained first as in the all-in-one mode requests on one server may still be
+// forwarded to the others. Watch streams are ended right away.
+func shutdown(nodes []*node, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		n.hub.close()
+		n.router.close()
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Printf("HTTP server %s shutdown failed, %v", s.Addr, err)
+			}
+		}(n.http)
+		if n.grpc != nil {
+			wg.Add(1)
+			go func(s *grpc.Server) {
+				defer wg.Done()
+				stopped := make(chan struct{})
+				go func() {
+					s.GracefulStop()
+					close(stopped)
+				}()
+				select {
+				case <-stopped:
+				case <-ctx.Done():
+					s.Stop()
+				}
+			}(n.grpc)
+		}
+	}
+	wg.Wait()
+	for _, n := range nodes {
+		n.nh.Close()
+	}
 }
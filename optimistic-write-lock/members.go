@@ -0,0 +1,182 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lni/dragonboat/v4"
+)
+
+const (
+	ReplicaTypeVoting    = "voting"
+	ReplicaTypeNonVoting = "nonvoting"
+	ReplicaTypeWitness   = "witness"
+)
+
+// membership is the JSON representation of dragonboat.Membership.
+type membership struct {
+	ConfigChangeID uint64            `json:"config_change_id"`
+	Voting         map[uint64]string `json:"voting"`
+	NonVoting      map[uint64]string `json:"non_voting"`
+	Witnesses      map[uint64]string `json:"witnesses"`
+	Removed        []uint64          `json:"removed"`
+}
+
+func newMembership(m *dragonboat.Membership) membership {
+	removed := make([]uint64, 0, len(m.Removed))
+	for id := range m.Removed {
+		removed = append(removed, id)
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	return membership{
+		ConfigChangeID: m.ConfigChangeID,
+		Voting:         m.Nodes,
+		NonVoting:      m.NonVotings,
+		Witnesses:      m.Witnesses,
+		Removed:        removed,
+	}
+}
+
+// addReplicaRequest adds a replica of the given type. ConfigChangeID is the
+// config_change_id of the membership the change is based on, the change is
+// rejected when the membership has changed since. It is required as
+// dragonboat skips the check for 0.
+type addReplicaRequest struct {
+	ReplicaID      uint64 `json:"replica_id"`
+	Addr           string `json:"addr"`
+	Type           string `json:"type"`
+	ConfigChangeID uint64 `json:"config_change_id"`
+}
+
+// members serves the membership admin endpoints -
+// GET /admin/members lists the members of the shard
+// POST /admin/members adds a voting, non-voting or witness replica
+// DELETE /admin/members/<id> removes a replica
+// POST /admin/members/<id>/leader transfers the leadership to a replica
+func (h *handler) members(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(ctx, w, r) {
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/members"), "/")
+	parts := strings.Split(path, "/")
+	if len(path) == 0 {
+		if r.Method == "GET" {
+			h.writeMembership(ctx, w)
+			return
+		}
+		if r.Method == "POST" {
+			h.addReplica(ctx, w, r)
+			return
+		}
+	} else if replicaID, err := strconv.ParseUint(parts[0], 10, 64); err == nil {
+		if r.Method == "DELETE" && len(parts) == 1 {
+			h.deleteReplica(ctx, w, r, replicaID)
+			return
+		}
+		if r.Method == "POST" && len(parts) == 2 && parts[1] == "leader" {
+			h.transferLeader(w, replicaID)
+			return
+		}
+	}
+	writeError(w, 405, ErrorCodeMethodNotAllowed, "Method not supported")
+}
+
+// requireAdmin rejects requests not made by an admin principal.
+func (h *handler) requireAdmin(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	if _, err := h.nh.SyncRead(ctx, h.shardID, AdminQuery{Token: token(r)}); err != nil {
+		h.readError(w, err)
+		return false
+	}
+	return true
+}
+
+func (h *handler) writeMembership(ctx context.Context, w http.ResponseWriter) {
+	m, err := h.nh.SyncGetShardMembership(ctx, h.shardID)
+	if err != nil {
+		writeRaftError(w, err)
+		return
+	}
+	b, _ := json.Marshal(newMembership(m))
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+func (h *handler) addReplica(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req addReplicaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, 400, ErrorCodeBadRequest, err.Error())
+		return
+	}
+	if req.ReplicaID == 0 || len(req.Addr) == 0 || req.ConfigChangeID == 0 {
+		writeError(w, 400, ErrorCodeBadRequest, "replica_id, addr and config_change_id are required")
+		return
+	}
+	ccid := req.ConfigChangeID
+	var err error
+	switch req.Type {
+	case ReplicaTypeVoting, "":
+		err = h.nh.SyncRequestAddReplica(ctx, h.shardID, req.ReplicaID, req.Addr, ccid)
+	case ReplicaTypeNonVoting:
+		err = h.nh.SyncRequestAddNonVoting(ctx, h.shardID, req.ReplicaID, req.Addr, ccid)
+	case ReplicaTypeWitness:
+		err = h.nh.SyncRequestAddWitness(ctx, h.shardID, req.ReplicaID, req.Addr, ccid)
+	default:
+		writeError(w, 400, ErrorCodeBadRequest, "type must be voting, nonvoting or witness")
+		return
+	}
+	h.membershipChanged(ctx, w, err)
+}
+
+func (h *handler) deleteReplica(ctx context.Context, w http.ResponseWriter, r *http.Request, replicaID uint64) {
+	ccid, err := strconv.ParseUint(r.FormValue("config_change_id"), 10, 64)
+	if err != nil || ccid == 0 {
+		writeError(w, 400, ErrorCodeBadRequest, "config_change_id must be a positive uint64")
+		return
+	}
+	err = h.nh.SyncRequestDeleteReplica(ctx, h.shardID, replicaID, ccid)
+	h.membershipChanged(ctx, w, err)
+}
+
+// membershipChanged writes the new membership after a successful change. A
+// rejected change means the membership was changed concurrently.
+func (h *handler) membershipChanged(ctx context.Context, w http.ResponseWriter, err error) {
+	if errors.Is(err, dragonboat.ErrRejected) {
+		writeError(w, 409, ErrorCodeMembershipChanged, "Membership change rejected, the membership has changed")
+		return
+	}
+	if err != nil {
+		writeRaftError(w, err)
+		return
+	}
+	h.writeMembership(ctx, w)
+}
+
+// transferLeader requests the leadership to be transferred, the transfer is
+// not guaranteed to happen.
+func (h *handler) transferLeader(w http.ResponseWriter, replicaID uint64) {
+	if err := h.nh.RequestLeaderTransfer(h.shardID, replicaID); err != nil {
+		writeRaftError(w, err)
+		return
+	}
+	w.WriteHeader(202)
+	w.Write([]byte("Leader transfer requested"))
+}
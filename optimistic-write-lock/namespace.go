@@ -0,0 +1,304 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v4"
+)
+
+const (
+	// nsPrefix is the path prefix of the requests made on a namespace, a
+	// request on /ns/name/key is served as a request on /key by the shard of
+	// the namespace name
+	nsPrefix = "/ns/"
+	// catalogPrefix is the reserved key space of the default shard holding
+	// the catalog, the namespace name is stored as the JSON encoded value of
+	// /_ns/name
+	catalogPrefix      = "/_ns/"
+	maxNamespaceLength = 64
+	// catalogRetryInterval is the delay before the catalog is read again
+	// after the shards of the namespaces failed to start
+	catalogRetryInterval = time.Second
+)
+
+// Namespace is an entry of the catalog, it maps a namespace to the shard
+// serving it. Owner is the admin who created the namespace while access
+// control was enabled, the shard starts with it as its first principal.
+type Namespace struct {
+	Name    string     `json:"name"`
+	ShardID uint64     `json:"shard_id"`
+	Owner   *Principal `json:"owner,omitempty"`
+}
+
+// CatalogQuery returns all namespaces of the catalog ordered by name.
+type CatalogQuery struct{}
+
+func validateNamespace(name string) error {
+	if len(name) == 0 || len(name) > maxNamespaceLength {
+		return fmt.Errorf("Namespace name must be 1 to %d characters long", maxNamespaceLength)
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return fmt.Errorf("Invalid namespace name %q, only a-z, 0-9, - and _ are allowed", name)
+		}
+	}
+	return nil
+}
+
+// public returns the namespace without the token hash of its owner.
+func (ns Namespace) public() Namespace {
+	if ns.Owner != nil {
+		owner := *ns.Owner
+		owner.TokenHash = ""
+		ns.Owner = &owner
+	}
+	return ns
+}
+
+// catalog returns the namespaces of the catalog.
+func (fsm *linearizableFSM) catalog() []Namespace {
+	namespaces := []Namespace{}
+	for _, entry := range fsm.scan(catalogPrefix) {
+		var ns Namespace
+		if err := json.Unmarshal([]byte(entry.Val), &ns); err == nil {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}
+
+// createNamespace adds the namespace named by the key of cmd to the catalog,
+// it is served by the shard after the highest one in use. Creating an existing
+// namespace returns it unchanged. With access control enabled, the creator is
+// recorded as the owner of the namespace, otherwise its shard starts without
+// access control like the default shard did.
+func (fsm *linearizableFSM) createNamespace(cmd Command, index uint64) (uint64, []byte) {
+	p, err := fsm.principal(cmd.Token)
+	if err != nil {
+		return ResultCodeUnauthenticated, []byte(err.Error())
+	}
+	if !p.Admin {
+		return ResultCodePermissionDenied, []byte(ErrPermissionDenied.Error())
+	}
+	if fsm.shardID != shardID {
+		return ResultCodeFailure, []byte("Namespaces can only be created in the default shard")
+	}
+	ns := Namespace{Name: cmd.Key, ShardID: shardID + 1}
+	if len(fsm.principals) > 0 {
+		ns.Owner = &p
+	}
+	for _, other := range fsm.catalog() {
+		if other.Name == ns.Name {
+			b, _ := json.Marshal(other)
+			return ResultCodeSuccess, b
+		}
+		if other.ShardID >= ns.ShardID {
+			ns.ShardID = other.ShardID + 1
+		}
+	}
+	b, _ := json.Marshal(ns)
+	fsm.set(Entry{Key: catalogPrefix + ns.Name, Ver: index, Val: string(b)})
+	return ResultCodeSuccess, b
+}
+
+// namespaceRouter starts the replicas of the namespace shards on a node and
+// routes the requests made on a namespace to the handler of its shard. Nodes
+// follow the catalog in the default shard and start the shard of each new
+// namespace with the peers as its initial members, nodes that joined the
+// default shard later aren't members of the namespace shards.
+type namespaceRouter struct {
+	nh   *dragonboat.NodeHost
+	opts nodeOptions
+	fwd  *forwarder
+	lim  *limiter
+	mu   sync.Mutex
+	// shards holds the handlers of the started namespace shards by name
+	shards map[string]*handler
+	stopc  chan struct{}
+}
+
+func newNamespaceRouter(nh *dragonboat.NodeHost, opts nodeOptions,
+	fwd *forwarder, lim *limiter) *namespaceRouter {
+	return &namespaceRouter{
+		nh:     nh,
+		opts:   opts,
+		fwd:    fwd,
+		lim:    lim,
+		shards: map[string]*handler{},
+		stopc:  make(chan struct{}),
+	}
+}
+
+// serving returns whether the node serves namespaces.
+func (n *namespaceRouter) serving() bool {
+	return !n.opts.join
+}
+
+// run starts the shards of the namespaces added to the catalog, which is read
+// each time the default shard applies entries.
+func (n *namespaceRouter) run(index *appliedIndex) {
+	if !n.serving() {
+		return
+	}
+	for {
+		next := index.next()
+		var retry <-chan time.Time
+		res, err := n.nh.StaleRead(shardID, CatalogQuery{})
+		if err == nil {
+			err = n.start(res.([]Namespace))
+		}
+		if errors.Is(err, dragonboat.ErrClosed) {
+			return
+		} else if err != nil {
+			if !errors.Is(err, dragonboat.ErrShardNotInitialized) {
+				log.Printf("Failed to start the namespace shards, %v", err)
+			}
+			retry = time.After(catalogRetryInterval)
+		}
+		select {
+		case <-next:
+		case <-retry:
+		case <-n.stopc:
+			return
+		}
+	}
+}
+
+// start starts the shards of the namespaces not started yet.
+func (n *namespaceRouter) start(namespaces []Namespace) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, ns := range namespaces {
+		if _, ok := n.shards[ns.Name]; ok {
+			continue
+		}
+		hub := newWatchHub()
+		index := newAppliedIndex()
+		err := startReplica(n.nh, ns.ShardID, n.opts, hub, index, ns.Owner)
+		if err != nil && !errors.Is(err, dragonboat.ErrShardAlreadyExist) {
+			return err
+		}
+		log.Printf("Started shard %d of namespace %s", ns.ShardID, ns.Name)
+		h := newHandler(n.nh, ns.ShardID, n.opts.replicaID, n.fwd, n.lim, index, hub)
+		h.prefix = nsPrefix + ns.Name
+		h.exportDir = n.opts.exportDir(ns.ShardID)
+		n.shards[ns.Name] = h
+	}
+	return nil
+}
+
+func (n *namespaceRouter) get(name string) (*handler, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	h, ok := n.shards[name]
+	return h, ok
+}
+
+// ServeHTTP serves a request made on a namespace. A namespace not started yet
+// is looked up in the catalog with a linearizable read, it may have been
+// created before the local replica of the default shard applied it.
+func (n *namespaceRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !n.serving() {
+		writeError(w, 503, ErrorCodeUnavailable, "Namespaces are only served by the initial members of the shard")
+		w.Write([]byte("\n"))
+		return
+	}
+	name := strings.SplitN(strings.TrimPrefix(r.URL.Path, nsPrefix), "/", 2)[0]
+	h, ok := n.get(name)
+	if !ok {
+		ctx, cancel := context.WithTimeout(r.Context(), defaultTimeout)
+		defer cancel()
+		res, err := n.nh.SyncRead(ctx, shardID, CatalogQuery{})
+		if err == nil {
+			err = n.start(res.([]Namespace))
+		}
+		if err != nil {
+			writeRaftError(w, err)
+			w.Write([]byte("\n"))
+			return
+		}
+		if h, ok = n.get(name); !ok {
+			writeError(w, 404, ErrorCodeNotFound, fmt.Sprintf("Namespace %q not found", name))
+			w.Write([]byte("\n"))
+			return
+		}
+	}
+	h.ServeHTTP(w, r)
+}
+
+// close ends the watch streams of all namespaces and stops following the
+// catalog.
+func (n *namespaceRouter) close() {
+	close(n.stopc)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, h := range n.shards {
+		h.hub.close()
+	}
+}
+
+// namespaces serves the admin endpoints listing and creating namespaces.
+func (h *handler) namespaces(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/namespaces"), "/")
+	if r.Method == "GET" && len(name) == 0 {
+		if !h.requireAdmin(ctx, w, r) {
+			return
+		}
+		res, err := h.nh.SyncRead(ctx, h.shardID, CatalogQuery{})
+		if err != nil {
+			h.readError(w, err)
+			return
+		}
+		namespaces := res.([]Namespace)
+		for i := range namespaces {
+			namespaces[i] = namespaces[i].public()
+		}
+		b, _ := json.Marshal(namespaces)
+		w.WriteHeader(200)
+		w.Write(b)
+		return
+	}
+	if r.Method != "PUT" || len(name) == 0 {
+		writeError(w, 405, ErrorCodeMethodNotAllowed, "Method not supported")
+		return
+	}
+	res, ok := h.propose(ctx, w, Command{Type: CommandTypeCreateNamespace, Entry: Entry{Key: name}, Token: token(r)})
+	if !ok {
+		return
+	}
+	// the local replica is started right away, the other nodes start theirs
+	// once they applied the entry
+	var ns Namespace
+	json.Unmarshal(res.Data, &ns)
+	if h.router != nil && h.router.serving() {
+		if err := h.router.start([]Namespace{ns}); err != nil {
+			writeError(w, 500, ErrorCodeInternal, err.Error())
+			return
+		}
+	}
+	b, _ := json.Marshal(ns.public())
+	w.WriteHeader(200)
+	w.Write(b)
+}
@@ -0,0 +1,126 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNamespaceOwner(t *testing.T) {
+	forEachStore(t, historyOptions{}, func(t *testing.T, sm *testFSM) {
+		// the shard of a namespace created with access control enabled
+		sm.fsm.owner = &Principal{Name: "root", TokenHash: hashToken("secret"), Admin: true}
+		sm.fsm.rebuildACL()
+		put := func(token string) uint64 {
+			key := fmt.Sprintf("/%d", sm.index)
+			return sm.propose(Command{Entry: Entry{Key: key, Val: "1"}, Token: hashToken(token)}).Value
+		}
+		if code := put(""); code != ResultCodeUnauthenticated {
+			t.Errorf("anonymous put returned %d", code)
+		}
+		if code := put("secret"); code != ResultCodeSuccess {
+			t.Errorf("put of the owner returned %d", code)
+		}
+		// the owner is replaced by a principal with the same name
+		p, _ := json.Marshal(Principal{Name: "root", TokenHash: hashToken("rotated"), Admin: true})
+		sm.mustPropose(Command{Type: CommandTypeSetPrincipal, Entry: Entry{Val: string(p)}, Token: hashToken("secret")})
+		if code := put("secret"); code != ResultCodeUnauthenticated {
+			t.Errorf("put with the replaced token returned %d", code)
+		}
+		if code := put("rotated"); code != ResultCodeSuccess {
+			t.Errorf("put with the new token returned %d", code)
+		}
+		// the owner is an admin of the shard again once its replacement is deleted
+		sm.mustPropose(Command{Type: CommandTypeDeletePrincipal, Entry: Entry{Key: "root"}, Token: hashToken("rotated")})
+		if code := put("secret"); code != ResultCodeSuccess {
+			t.Errorf("put of the owner after the deletion returned %d", code)
+		}
+	})
+}
+
+func TestNamespaceACL(t *testing.T) {
+	_, url := startTestNode(t)
+	client := &http.Client{Timeout: 5 * time.Second}
+	do := func(method, path, token, body string) int {
+		req, err := http.NewRequest(method, url+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to create the request, %v", err)
+		}
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed, %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := do("PUT", "/admin/acl/root", "", `{"token":"secret","admin":true}`); code != 200 {
+		t.Fatalf("failed to enable access control, %d", code)
+	}
+	if code := do("PUT", "/admin/namespaces/orders", "secret", ""); code != 200 {
+		t.Fatalf("failed to create the namespace, %d", code)
+	}
+	// the shard of the namespace elects its leader after it was created
+	for deadline := time.Now().Add(20 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		if do("PUT", "/ns/orders/a?val=1", "secret", "") == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("put in the namespace failed")
+		}
+	}
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		body   string
+		code   int
+	}{
+		{"GET", "/ns/orders/a", "", "", 401},
+		{"PUT", "/ns/orders/b?val=1", "", "", 401},
+		{"PUT", "/ns/orders/admin/acl/x", "", `{"token":"x","admin":true}`, 401},
+		{"PUT", "/ns/orders/admin/acl/x", "wrong", `{"token":"x","admin":true}`, 401},
+		{"GET", "/ns/orders/a", "secret", "", 200},
+		{"GET", "/admin/namespaces", "secret", "", 200},
+	}
+	for _, tt := range tests {
+		if code := do(tt.method, tt.path, tt.token, tt.body); code != tt.code {
+			t.Errorf("%s %s with token %q returned %d, want %d", tt.method, tt.path, tt.token, code, tt.code)
+		}
+	}
+	// the token hash of the owner isn't returned
+	req, _ := http.NewRequest("GET", url+"/admin/namespaces", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("failed to list the namespaces, %v", err)
+	}
+	defer resp.Body.Close()
+	var namespaces []Namespace
+	if err := json.NewDecoder(resp.Body).Decode(&namespaces); err != nil {
+		t.Fatalf("failed to decode the namespaces, %v", err)
+	}
+	if len(namespaces) != 1 || namespaces[0].Owner == nil || namespaces[0].Owner.Name != "root" ||
+		len(namespaces[0].Owner.TokenHash) != 0 {
+		t.Errorf("namespaces are %+v", namespaces)
+	}
+}
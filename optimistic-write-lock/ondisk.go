@@ -0,0 +1,488 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	dbsm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+const (
+	// StorageMemory keeps the state machine in memory, it is rebuilt from the
+	// latest snapshot and the log when the node restarts
+	StorageMemory = "memory"
+	// StorageDisk keeps the state machine in a Pebble database, the node
+	// resumes from the last entry applied to the database when it restarts
+	StorageDisk = "disk"
+	// currentDBFilename holds the name of the database directory in use
+	currentDBFilename = "current"
+	// bulkBatchSize bounds the write batches used to recover from snapshots
+	bulkBatchSize = 4 << 20
+)
+
+// The key spaces of the database, each is a single byte prefix.
+var (
+	dataPrefix    = []byte("d")
+	historyPrefix = []byte("h")
+	expiryPrefix  = []byte("e")
+	stateKey      = []byte("s")
+)
+
+var errStateMachineClosed = errors.New("state machine closed")
+
+// diskState is the state of the on disk state machine besides its entries and
+// history, it is written with each batch of applied entries.
+type diskState struct {
+	snapshotMeta
+	Now int64 `json:"now"`
+}
+
+// diskStore is the store of the on disk state machine. Entries are stored as
+// JSON under their key, prior versions as a JSON list per key and the expiry
+// queue as keys ordered by the replaced time.
+type diskStore struct {
+	db *pebble.DB
+	// r reads the database, or the batch while entries are applied
+	r pebble.Reader
+	b *pebble.Batch
+	// bulk applies the batch each time it reaches bulkBatchSize, it is set
+	// while a snapshot is loaded
+	bulk bool
+}
+
+func newDiskStore(db *pebble.DB) *diskStore {
+	return &diskStore{db: db, r: db}
+}
+
+// begin starts the batch holding the changes of the entries being applied,
+// reads see the changes made so far.
+func (s *diskStore) begin() {
+	s.b = s.db.NewIndexedBatch()
+	s.r = s.b
+}
+
+// beginBulk starts a batch to load a snapshot into an empty database, the
+// changes are not visible until commit.
+func (s *diskStore) beginBulk() {
+	s.b = s.db.NewBatch()
+	s.bulk = true
+}
+
+// commit applies the batch to the database.
+func (s *diskStore) commit(opts *pebble.WriteOptions) error {
+	err := s.db.Apply(s.b, opts)
+	s.b.Close()
+	s.b, s.r, s.bulk = nil, s.db, false
+	return err
+}
+
+func (s *diskStore) setState(state diskState) {
+	s.write(stateKey, state)
+}
+
+func (s *diskStore) state() diskState {
+	var state diskState
+	s.read(stateKey, &state)
+	return state
+}
+
+// read decodes the value of key into v, it returns false when key doesn't
+// exist. The store can't recover from errors of the database, they panic
+// like the other errors of the state machine would.
+func (s *diskStore) read(key []byte, v interface{}) bool {
+	val, closer, err := s.r.Get(key)
+	if err == pebble.ErrNotFound {
+		return false
+	}
+	if err != nil {
+		panic(err)
+	}
+	defer closer.Close()
+	if err := json.Unmarshal(val, v); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+func (s *diskStore) write(key []byte, v interface{}) {
+	var val []byte
+	if v != nil {
+		val, _ = json.Marshal(v)
+	}
+	if err := s.b.Set(key, val, nil); err != nil {
+		panic(err)
+	}
+	if s.bulk && s.b.Len() >= bulkBatchSize {
+		if err := s.db.Apply(s.b, pebble.NoSync); err != nil {
+			panic(err)
+		}
+		s.b.Close()
+		s.b = s.db.NewBatch()
+	}
+}
+
+func (s *diskStore) delete(key []byte) {
+	if err := s.b.Delete(key, nil); err != nil {
+		panic(err)
+	}
+}
+
+// iterate calls f with the keys starting with prefix from start in key order,
+// without the prefix, and their values until f returns false.
+func (s *diskStore) iterate(prefix, start, end []byte, f func(key, val []byte) bool) {
+	if end == nil {
+		end = []byte{prefix[0] + 1}
+	}
+	iter := s.r.NewIter(&pebble.IterOptions{LowerBound: start, UpperBound: end})
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if !f(iter.Key()[len(prefix):], iter.Value()) {
+			return
+		}
+	}
+}
+
+func (s *diskStore) get(key string) (Entry, bool) {
+	var entry Entry
+	ok := s.read(prefixed(dataPrefix, key), &entry)
+	return entry, ok
+}
+
+func (s *diskStore) set(entry Entry) {
+	s.write(prefixed(dataPrefix, entry.Key), entry)
+}
+
+func (s *diskStore) remove(key string) {
+	s.delete(prefixed(dataPrefix, key))
+}
+
+func (s *diskStore) scan(start string, f func(Entry) bool) {
+	s.iterate(dataPrefix, prefixed(dataPrefix, start), nil, func(key, val []byte) bool {
+		var entry Entry
+		if err := json.Unmarshal(val, &entry); err != nil {
+			panic(err)
+		}
+		return f(entry)
+	})
+}
+
+func (s *diskStore) revisions(key string) []Revision {
+	var versions []Revision
+	s.read(prefixed(historyPrefix, key), &versions)
+	return versions
+}
+
+func (s *diskStore) setRevisions(key string, versions []Revision) {
+	if len(versions) == 0 {
+		s.delete(prefixed(historyPrefix, key))
+	} else {
+		s.write(prefixed(historyPrefix, key), versions)
+	}
+}
+
+func (s *diskStore) scanHistory(f func(key string, versions []Revision) bool) {
+	s.iterate(historyPrefix, historyPrefix, nil, func(key, val []byte) bool {
+		var versions []Revision
+		if err := json.Unmarshal(val, &versions); err != nil {
+			panic(err)
+		}
+		return f(string(key), versions)
+	})
+}
+
+// expiryKey orders the refs by their replaced time and then by version, the
+// prior versions of a key are thus popped oldest first.
+func expiryKey(replaced int64, ver uint64, key string) []byte {
+	k := make([]byte, len(expiryPrefix)+16, len(expiryPrefix)+16+len(key))
+	copy(k, expiryPrefix)
+	binary.BigEndian.PutUint64(k[len(expiryPrefix):], uint64(replaced))
+	binary.BigEndian.PutUint64(k[len(expiryPrefix)+8:], ver)
+	return append(k, key...)
+}
+
+func (s *diskStore) pushExpiry(ref historyRef) {
+	s.write(expiryKey(ref.replaced, ref.ver, ref.key), nil)
+}
+
+func (s *diskStore) popExpired(cutoff int64) []historyRef {
+	if cutoff <= 0 {
+		return nil
+	}
+	var refs []historyRef
+	var keys [][]byte
+	s.iterate(expiryPrefix, expiryPrefix, expiryKey(cutoff, 0, ""), func(key, val []byte) bool {
+		refs = append(refs, historyRef{
+			key:      string(key[16:]),
+			ver:      binary.BigEndian.Uint64(key[8:16]),
+			replaced: int64(binary.BigEndian.Uint64(key[:8])),
+		})
+		keys = append(keys, append(append([]byte{}, expiryPrefix...), key...))
+		return true
+	})
+	for _, key := range keys {
+		s.delete(key)
+	}
+	return refs
+}
+
+func prefixed(prefix []byte, key string) []byte {
+	return append(append(make([]byte, 0, len(prefix)+len(key)), prefix...), key...)
+}
+
+// NewOnDiskFSM returns the factory of the on disk state machine storing its
+// data in a directory per replica under dir. It applies commands exactly like
+// the in memory state machine of NewLinearizableFSM, but its data is bounded by
+// the disk rather than the memory, and restarts don't replay the log.
+func NewOnDiskFSM(dir string, hub *watchHub, index *appliedIndex,
+	history historyOptions, owner *Principal) dbsm.CreateOnDiskStateMachineFunc {
+	return dbsm.CreateOnDiskStateMachineFunc(func(shardID, replicaID uint64) dbsm.IOnDiskStateMachine {
+		return &onDiskFSM{
+			linearizableFSM: newLinearizableFSM(shardID, replicaID, nil, hub, index, history, owner),
+			dir:             onDiskReplicaDir(dir, shardID, replicaID),
+		}
+	})
+}
+
+// onDiskReplicaDir returns the directory of the on disk state machine of a
+// replica under dir.
+func onDiskReplicaDir(dir string, shardID, replicaID uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%d_%d", shardID, replicaID))
+}
+
+// onDiskFSM is the on disk state machine. Each batch of entries is written to
+// the database in a single batch together with the applied index, which is
+// synced when NodeHost calls Sync. Recovering from a snapshot loads it into a
+// new database which then replaces the current one.
+type onDiskFSM struct {
+	*linearizableFSM
+	dir    string
+	db     *diskStore
+	closed bool
+}
+
+// Open opens the current database of the replica and returns the index of the
+// last entry applied to it.
+func (fsm *onDiskFSM) Open(stopc <-chan struct{}) (uint64, error) {
+	if err := os.MkdirAll(fsm.dir, 0777); err != nil {
+		return 0, err
+	}
+	name, err := fsm.currentDB()
+	if err != nil {
+		return 0, err
+	}
+	if len(name) == 0 {
+		name = newDBName()
+		if err := fsm.setCurrentDB(name); err != nil {
+			return 0, err
+		}
+	}
+	// databases left behind by an interrupted recovery
+	if err := fsm.removeDBs(name); err != nil {
+		return 0, err
+	}
+	db, err := pebble.Open(filepath.Join(fsm.dir, name), &pebble.Options{})
+	if err != nil {
+		return 0, err
+	}
+	s := newDiskStore(db)
+	state := s.state()
+	fsm.mu.Lock()
+	fsm.db = s
+	fsm.store = s
+	fsm.applied = state.Applied
+	fsm.lockClock = state.LockClock
+	fsm.now = state.Now
+	fsm.rebuildACL()
+	fsm.mu.Unlock()
+	if state.Applied != 0 {
+		fsm.recovered(state.Applied)
+	}
+	return state.Applied, nil
+}
+
+func (fsm *onDiskFSM) Update(entries []dbsm.Entry) ([]dbsm.Entry, error) {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+	fsm.db.begin()
+	fsm.apply(entries)
+	fsm.db.setState(fsm.state())
+	if err := fsm.db.commit(pebble.NoSync); err != nil {
+		return nil, err
+	}
+	fsm.publish()
+	return entries, nil
+}
+
+func (fsm *onDiskFSM) Lookup(e interface{}) (interface{}, error) {
+	fsm.mu.RLock()
+	defer fsm.mu.RUnlock()
+	if fsm.closed {
+		return nil, errStateMachineClosed
+	}
+	return fsm.lookup(e)
+}
+
+// Sync syncs the write ahead log of the database, the entries applied until
+// now survive a crash.
+func (fsm *onDiskFSM) Sync() error {
+	fsm.mu.RLock()
+	defer fsm.mu.RUnlock()
+	return fsm.db.db.LogData(nil, pebble.Sync)
+}
+
+func (fsm *onDiskFSM) state() diskState {
+	return diskState{snapshotMeta: fsm.meta(), Now: fsm.now}
+}
+
+// diskSnapshot is a point in time view of the database to be saved.
+type diskSnapshot struct {
+	snapshot *pebble.Snapshot
+	state    diskState
+}
+
+func (fsm *onDiskFSM) PrepareSnapshot() (interface{}, error) {
+	fsm.mu.RLock()
+	defer fsm.mu.RUnlock()
+	return &diskSnapshot{snapshot: fsm.db.db.NewSnapshot(), state: fsm.state()}, nil
+}
+
+// SaveSnapshot streams the database view in the same format as the snapshots
+// of the in memory state machine.
+func (fsm *onDiskFSM) SaveSnapshot(ctx interface{}, w io.Writer, done <-chan struct{}) error {
+	ss := ctx.(*diskSnapshot)
+	defer ss.snapshot.Close()
+	s := &diskStore{r: ss.snapshot}
+	return writeSnapshot(w, s, ss.state.Now, ss.state.snapshotMeta)
+}
+
+func (fsm *onDiskFSM) RecoverFromSnapshot(r io.Reader, done <-chan struct{}) error {
+	name := newDBName()
+	db, err := pebble.Open(filepath.Join(fsm.dir, name), &pebble.Options{})
+	if err != nil {
+		return err
+	}
+	s := newDiskStore(db)
+	s.beginBulk()
+	now, meta, err := readSnapshot(r, s)
+	if err == nil {
+		err = s.commit(pebble.NoSync)
+	}
+	if err != nil {
+		db.Close()
+		os.RemoveAll(filepath.Join(fsm.dir, name))
+		return err
+	}
+	fsm.mu.Lock()
+	old := fsm.db
+	s.begin()
+	fsm.recover(s, now, meta)
+	s.setState(fsm.state())
+	if err = s.commit(pebble.Sync); err == nil {
+		err = fsm.setCurrentDB(name)
+	}
+	fsm.db = s
+	fsm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	fsm.recovered(meta.Applied)
+	old.db.Close()
+	return fsm.removeDBs(name)
+}
+
+func (fsm *onDiskFSM) Close() error {
+	fsm.mu.Lock()
+	defer fsm.mu.Unlock()
+	if fsm.closed || fsm.db == nil {
+		return nil
+	}
+	fsm.closed = true
+	return fsm.db.db.Close()
+}
+
+func newDBName() string {
+	return fmt.Sprintf("db-%d", time.Now().UnixNano())
+}
+
+// currentDB returns the name of the database directory in use, it is empty
+// when the replica has no database yet.
+func (fsm *onDiskFSM) currentDB() (string, error) {
+	b, err := os.ReadFile(filepath.Join(fsm.dir, currentDBFilename))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(b)), err
+}
+
+// setCurrentDB atomically replaces the name of the database directory in use.
+func (fsm *onDiskFSM) setCurrentDB(name string) error {
+	tmp := filepath.Join(fsm.dir, currentDBFilename+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(name + "\n"); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(fsm.dir, currentDBFilename)); err != nil {
+		return err
+	}
+	return syncDir(fsm.dir)
+}
+
+// removeDBs removes the database directories other than current.
+func (fsm *onDiskFSM) removeDBs(current string) error {
+	entries, err := os.ReadDir(fsm.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != current {
+			if err := os.RemoveAll(filepath.Join(fsm.dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
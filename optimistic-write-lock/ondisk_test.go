@@ -0,0 +1,132 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snapshotState is the state of a state machine compared across snapshots.
+type snapshotState struct {
+	entries   []Entry
+	history   History
+	applied   uint64
+	lockClock int64
+	now       int64
+}
+
+func (sm *testFSM) snapshotState() snapshotState {
+	res, err := sm.lookup(ListQuery{})
+	if err != nil {
+		sm.t.Fatalf("failed to list the entries, %v", err)
+	}
+	sm.fsm.mu.RLock()
+	defer sm.fsm.mu.RUnlock()
+	return snapshotState{
+		entries:   res.(ListResult).Entries,
+		history:   sm.history("/a"),
+		applied:   sm.fsm.applied,
+		lockClock: sm.fsm.lockClock,
+		now:       sm.fsm.now,
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	history := historyOptions{count: 3, age: time.Hour}
+	stores := []struct {
+		name string
+		new  func(*testing.T, historyOptions) *testFSM
+	}{
+		{StorageMemory, newMemoryTestFSM},
+		{StorageDisk, newDiskTestFSM},
+	}
+	for _, from := range stores {
+		for _, to := range stores {
+			t.Run(from.name+" to "+to.name, func(t *testing.T) {
+				src := from.new(t, history)
+				start := time.Now().UnixNano()
+				src.mustPropose(Command{Entry: Entry{Key: "/a", Val: "1"}, Time: start})
+				src.mustPropose(Command{Entry: Entry{Key: "/a", Ver: 1, Val: "2"}, Time: start + 1})
+				src.mustPropose(Command{Entry: Entry{Key: "/b", Val: "1"}, Time: start + 2})
+				src.mustPropose(Command{Type: CommandTypeDelete, Entry: Entry{Key: "/b"}, Time: start + 3})
+				src.mustPropose(Command{Type: CommandTypeLock, Entry: Entry{Key: "/l", Val: "owner"},
+					TTL: int64(time.Minute), Time: start + 4})
+				var buf bytes.Buffer
+				if err := src.save(&buf); err != nil {
+					t.Fatalf("failed to save the snapshot, %v", err)
+				}
+				dst := to.new(t, history)
+				dst.mustPropose(Command{Entry: Entry{Key: "/c", Val: "replaced"}})
+				if err := dst.recover(&buf); err != nil {
+					t.Fatalf("failed to recover from the snapshot, %v", err)
+				}
+				dst.index = src.index
+				want, got := src.snapshotState(), dst.snapshotState()
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("recovered state %+v, want %+v", got, want)
+				}
+				if got.applied != src.index || got.lockClock != start+4 {
+					t.Errorf("recovered applied index %d and lock clock %d, want %d and %d",
+						got.applied, got.lockClock, src.index, start+4)
+				}
+				// both continue with the same versions, the lock is still held
+				for _, sm := range []*testFSM{src, dst} {
+					sm.mustPropose(Command{Entry: Entry{Key: "/a", Ver: 2, Val: "3"}, Time: start + 5})
+					lock := Command{Type: CommandTypeLock, Entry: Entry{Key: "/l", Val: "other"},
+						TTL: int64(time.Minute), Time: start + 6}
+					if res := sm.propose(lock); res.Value != ResultCodeLocked {
+						t.Errorf("lock of a held lock returned %d", res.Value)
+					}
+				}
+				if want, got := src.snapshotState(), dst.snapshotState(); !reflect.DeepEqual(got, want) {
+					t.Errorf("state after recovery %+v, want %+v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestReadTruncatedSnapshot(t *testing.T) {
+	s := newMemoryStore()
+	s.set(Entry{Key: "/a", Ver: 2, Val: "2"})
+	s.set(Entry{Key: "/b", Ver: 3, Val: "3"})
+	s.setRevisions("/a", []Revision{{Entry: Entry{Key: "/a", Ver: 1, Val: "1"}, Replaced: 5}})
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, s, 10, snapshotMeta{}); err != nil {
+		t.Fatalf("failed to write the snapshot, %v", err)
+	}
+	data := buf.String()
+	// snapshots ending after the entries or the history are older snapshots,
+	// the others are truncated
+	complete := map[int]bool{len(data): true}
+	for i, c := range data {
+		if c == '\n' {
+			complete[i] = true
+			complete[i+1] = true
+		}
+	}
+	for n := 0; n <= len(data); n++ {
+		_, _, err := readSnapshot(strings.NewReader(data[:n]), newMemoryStore())
+		if complete[n] && err != nil {
+			t.Errorf("snapshot of %d bytes returned %v", n, err)
+		} else if !complete[n] && err == nil {
+			t.Errorf("snapshot truncated to %d bytes was read", n)
+		}
+	}
+}
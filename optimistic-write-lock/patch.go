@@ -0,0 +1,193 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	dbsm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+const (
+	PatchOpIncr        = "incr"
+	PatchOpDecr        = "decr"
+	PatchOpAppend      = "append"
+	PatchOpSetIfAbsent = "set-if-absent"
+	PatchOpMerge       = "merge"
+)
+
+// Patch is an operation evaluated by the state machine on the current value
+// of a key. incr and decr add or subtract By from an integer value, the
+// command is rejected when the result falls outside of Min and Max. append
+// adds the JSON value in the command's Val to the JSON array stored at the
+// key, merge applies Val to the stored JSON object as a JSON merge patch
+// (RFC 7386). A missing key holds 0, an empty array or an empty object
+// respectively. set-if-absent sets Val when the key doesn't exist.
+type Patch struct {
+	Op  string `json:"op"`
+	By  int64  `json:"by,omitempty"`
+	Min *int64 `json:"min,omitempty"`
+	Max *int64 `json:"max,omitempty"`
+}
+
+func (p *Patch) validate(val string) error {
+	if p == nil {
+		return fmt.Errorf("Missing patch")
+	}
+	switch p.Op {
+	case PatchOpIncr, PatchOpDecr:
+		if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+			return fmt.Errorf("Min %d is greater than max %d", *p.Min, *p.Max)
+		}
+	case PatchOpAppend, PatchOpMerge:
+		if !json.Valid([]byte(val)) {
+			return fmt.Errorf("Value of the %s op must be JSON", p.Op)
+		}
+	case PatchOpSetIfAbsent:
+	default:
+		return fmt.Errorf("Invalid patch op %q", p.Op)
+	}
+	return nil
+}
+
+// patch applies the patch of cmd to its key. The expected version in cmd is
+// checked when it is not 0, the key must exist when MustExist is set.
+func (fsm *linearizableFSM) patch(cmd Command, index uint64) dbsm.Result {
+	current, exists := fsm.store.get(cmd.Key)
+	if !exists {
+		current = Entry{Key: cmd.Key}
+	}
+	data, _ := json.Marshal(current)
+	if (cmd.Patch.Op == PatchOpSetIfAbsent && exists) || (cmd.MustExist && !exists) ||
+		(cmd.Ver != 0 && current.Ver != cmd.Ver) {
+		return dbsm.Result{Value: ResultCodeVersionMismatch, Data: data}
+	}
+	var val string
+	var err error
+	switch cmd.Patch.Op {
+	case PatchOpIncr, PatchOpDecr:
+		var ok bool
+		if val, ok, err = cmd.Patch.add(current.Val, exists); err == nil && !ok {
+			return dbsm.Result{Value: ResultCodeOutOfRange, Data: data}
+		}
+	case PatchOpAppend:
+		val, err = appendJSON(current.Val, exists, cmd.Val)
+	case PatchOpMerge:
+		val, err = mergeJSON(current.Val, exists, cmd.Val)
+	case PatchOpSetIfAbsent:
+		val = cmd.Val
+	}
+	if err == nil {
+		err = validateValue(val)
+	}
+	if err != nil {
+		return rejected(fmt.Errorf("Failed to %s %q, %w", cmd.Patch.Op, cmd.Key, err))
+	}
+	entry := Entry{Key: cmd.Key, Ver: index, Val: val}
+	fsm.set(entry)
+	b, _ := json.Marshal(entry)
+	return dbsm.Result{
+		Value: ResultCodeSuccess,
+		Data:  b,
+	}
+}
+
+// add returns the incremented or decremented value, ok is false when it
+// overflows or falls outside of the bounds.
+func (p *Patch) add(val string, exists bool) (string, bool, error) {
+	var n int64
+	if exists {
+		var err error
+		if n, err = strconv.ParseInt(val, 10, 64); err != nil {
+			return "", false, fmt.Errorf("value is not an integer")
+		}
+	}
+	by := p.By
+	if p.Op == PatchOpDecr {
+		if by == math.MinInt64 {
+			return "", false, nil
+		}
+		by = -by
+	}
+	if (by > 0 && n > math.MaxInt64-by) || (by < 0 && n < math.MinInt64-by) {
+		return "", false, nil
+	}
+	n += by
+	if (p.Min != nil && n < *p.Min) || (p.Max != nil && n > *p.Max) {
+		return "", false, nil
+	}
+	return strconv.FormatInt(n, 10), true, nil
+}
+
+// appendJSON appends the JSON value elem to the JSON array val.
+func appendJSON(val string, exists bool, elem string) (string, error) {
+	list := []json.RawMessage{}
+	if exists {
+		if err := json.Unmarshal([]byte(val), &list); err != nil || list == nil {
+			return "", fmt.Errorf("value is not a JSON array")
+		}
+	}
+	list = append(list, json.RawMessage(elem))
+	b, err := json.Marshal(list)
+	return string(b), err
+}
+
+// mergeJSON applies the JSON merge patch to the JSON object val.
+func mergeJSON(val string, exists bool, patch string) (string, error) {
+	var target interface{} = map[string]interface{}{}
+	if exists {
+		if err := decodeJSON(val, &target); err != nil {
+			return "", fmt.Errorf("value is not JSON")
+		}
+	}
+	var p interface{}
+	if err := decodeJSON(patch, &p); err != nil {
+		return "", err
+	}
+	// maps are marshaled with sorted keys, so all replicas store the same value
+	b, err := json.Marshal(mergePatch(target, p))
+	return string(b), err
+}
+
+// mergePatch implements the MergePatch function of RFC 7386.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// decodeJSON decodes s keeping numbers as they were written.
+func decodeJSON(s string, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
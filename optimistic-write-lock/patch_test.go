@@ -0,0 +1,175 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func int64p(v int64) *int64 {
+	return &v
+}
+
+func TestPatchAdd(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial string
+		patch   Patch
+		code    uint64
+		val     string
+	}{
+		{"incr missing key", "", Patch{Op: PatchOpIncr, By: 1}, ResultCodeSuccess, "1"},
+		{"decr missing key", "", Patch{Op: PatchOpDecr, By: 1}, ResultCodeSuccess, "-1"},
+		{"incr", "41", Patch{Op: PatchOpIncr, By: 1}, ResultCodeSuccess, "42"},
+		{"incr by negative", "1", Patch{Op: PatchOpIncr, By: -3}, ResultCodeSuccess, "-2"},
+		{"decr by negative", "1", Patch{Op: PatchOpDecr, By: -3}, ResultCodeSuccess, "4"},
+		{"incr to max", fmt.Sprint(int64(math.MaxInt64 - 1)), Patch{Op: PatchOpIncr, By: 1},
+			ResultCodeSuccess, fmt.Sprint(int64(math.MaxInt64))},
+		{"incr overflow", fmt.Sprint(int64(math.MaxInt64)), Patch{Op: PatchOpIncr, By: 1}, ResultCodeOutOfRange, ""},
+		{"incr by max overflow", "1", Patch{Op: PatchOpIncr, By: math.MaxInt64}, ResultCodeOutOfRange, ""},
+		{"incr underflow", fmt.Sprint(int64(math.MinInt64)), Patch{Op: PatchOpIncr, By: -1}, ResultCodeOutOfRange, ""},
+		{"decr to min", fmt.Sprint(int64(math.MinInt64 + 1)), Patch{Op: PatchOpDecr, By: 1},
+			ResultCodeSuccess, fmt.Sprint(int64(math.MinInt64))},
+		{"decr underflow", fmt.Sprint(int64(math.MinInt64)), Patch{Op: PatchOpDecr, By: 1}, ResultCodeOutOfRange, ""},
+		// negating the minimum overflows
+		{"decr by min", "0", Patch{Op: PatchOpDecr, By: math.MinInt64}, ResultCodeOutOfRange, ""},
+		{"decr by max", "0", Patch{Op: PatchOpDecr, By: math.MaxInt64}, ResultCodeSuccess, fmt.Sprint(-int64(math.MaxInt64))},
+		{"within bounds", "4", Patch{Op: PatchOpIncr, By: 1, Min: int64p(0), Max: int64p(5)}, ResultCodeSuccess, "5"},
+		{"above max", "5", Patch{Op: PatchOpIncr, By: 1, Max: int64p(5)}, ResultCodeOutOfRange, ""},
+		{"below min", "0", Patch{Op: PatchOpDecr, By: 1, Min: int64p(0)}, ResultCodeOutOfRange, ""},
+		{"not an integer", "1.5", Patch{Op: PatchOpIncr, By: 1}, ResultCodeFailure, ""},
+		{"padded integer", " 1", Patch{Op: PatchOpIncr, By: 1}, ResultCodeFailure, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, historyOptions{}, func(t *testing.T, sm *testFSM) {
+				if len(tt.initial) > 0 {
+					sm.mustPropose(Command{Entry: Entry{Key: "/n", Val: tt.initial}})
+				}
+				res := sm.propose(Command{Type: CommandTypePatch, Entry: Entry{Key: "/n"}, Patch: &tt.patch})
+				if res.Value != tt.code {
+					t.Fatalf("result %d, want %d, %s", res.Value, tt.code, res.Data)
+				}
+				entry, ok := sm.get("/n")
+				if tt.code != ResultCodeSuccess {
+					// rejected patches leave the value unchanged
+					if len(tt.initial) > 0 && entry.Val != tt.initial {
+						t.Errorf("value changed to %q", entry.Val)
+					}
+					return
+				}
+				if !ok || entry.Val != tt.val || entry.Ver != sm.index {
+					t.Errorf("value is %+v, want %q at version %d", entry, tt.val, sm.index)
+				}
+			})
+		})
+	}
+}
+
+func TestPatchMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial string
+		patch   string
+		code    uint64
+		val     string
+	}{
+		// the examples of RFC 7386, applied to an object
+		{"replace", `{"a":"b"}`, `{"a":"c"}`, ResultCodeSuccess, `{"a":"c"}`},
+		{"add", `{"a":"b"}`, `{"b":"c"}`, ResultCodeSuccess, `{"a":"b","b":"c"}`},
+		{"remove", `{"a":"b"}`, `{"a":null}`, ResultCodeSuccess, `{}`},
+		{"remove one", `{"a":"b","b":"c"}`, `{"a":null}`, ResultCodeSuccess, `{"b":"c"}`},
+		{"replace array", `{"a":["b"]}`, `{"a":"c"}`, ResultCodeSuccess, `{"a":"c"}`},
+		{"replace with array", `{"a":"c"}`, `{"a":["b"]}`, ResultCodeSuccess, `{"a":["b"]}`},
+		{"nested", `{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, ResultCodeSuccess, `{"a":{"b":"d"}}`},
+		{"arrays are replaced", `{"a":[{"b":"c"}]}`, `{"a":[1]}`, ResultCodeSuccess, `{"a":[1]}`},
+		{"replace scalar", `{"e":null}`, `{"a":1}`, ResultCodeSuccess, `{"a":1,"e":null}`},
+		{"nested into scalar", `{"a":"foo"}`, `{"a":{"bb":{"ccc":null}}}`, ResultCodeSuccess, `{"a":{"bb":{}}}`},
+		{"non-object patch", `{"a":"b"}`, `["c"]`, ResultCodeSuccess, `["c"]`},
+		{"null patch", `{"a":"b"}`, `null`, ResultCodeSuccess, `null`},
+		{"missing key", "", `{"a":{"b":null,"c":1}}`, ResultCodeSuccess, `{"a":{"c":1}}`},
+		// numbers are kept as written
+		{"large numbers", `{"a":12345678901234567890}`, `{"b":1.50}`, ResultCodeSuccess,
+			`{"a":12345678901234567890,"b":1.50}`},
+		{"keys are sorted", `{"b":1}`, `{"c":1,"a":1}`, ResultCodeSuccess, `{"a":1,"b":1,"c":1}`},
+		{"value is not JSON", `not json`, `{"a":1}`, ResultCodeFailure, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, historyOptions{}, func(t *testing.T, sm *testFSM) {
+				if len(tt.initial) > 0 {
+					sm.mustPropose(Command{Entry: Entry{Key: "/o", Val: tt.initial}})
+				}
+				cmd := Command{
+					Type:  CommandTypePatch,
+					Entry: Entry{Key: "/o", Val: tt.patch},
+					Patch: &Patch{Op: PatchOpMerge},
+				}
+				res := sm.propose(cmd)
+				if res.Value != tt.code {
+					t.Fatalf("result %d, want %d, %s", res.Value, tt.code, res.Data)
+				}
+				if tt.code != ResultCodeSuccess {
+					return
+				}
+				if entry, ok := sm.get("/o"); !ok || entry.Val != tt.val {
+					t.Errorf("value is %q, want %q", entry.Val, tt.val)
+				}
+			})
+		})
+	}
+}
+
+func TestPatchConditions(t *testing.T) {
+	forEachStore(t, historyOptions{}, func(t *testing.T, sm *testFSM) {
+		incr := func(ver uint64) uint64 {
+			return sm.propose(Command{
+				Type:  CommandTypePatch,
+				Entry: Entry{Key: "/n", Ver: ver},
+				Patch: &Patch{Op: PatchOpIncr, By: 1},
+			}).Value
+		}
+		if code := incr(1); code != ResultCodeVersionMismatch {
+			t.Errorf("patch of a missing key at version 1 returned %d", code)
+		}
+		if code := incr(0); code != ResultCodeSuccess {
+			t.Errorf("unconditional patch returned %d", code)
+		}
+		if code := incr(1); code != ResultCodeVersionMismatch {
+			t.Errorf("patch at a stale version returned %d", code)
+		}
+		if code := incr(2); code != ResultCodeSuccess {
+			t.Errorf("patch at the current version returned %d", code)
+		}
+		set := func(val string) uint64 {
+			return sm.propose(Command{
+				Type:  CommandTypePatch,
+				Entry: Entry{Key: "/s", Val: val},
+				Patch: &Patch{Op: PatchOpSetIfAbsent},
+			}).Value
+		}
+		if code := set("a"); code != ResultCodeSuccess {
+			t.Errorf("set-if-absent of a missing key returned %d", code)
+		}
+		if code := set("b"); code != ResultCodeVersionMismatch {
+			t.Errorf("set-if-absent of an existing key returned %d", code)
+		}
+		if entry, _ := sm.get("/s"); entry.Val != "a" {
+			t.Errorf("value is %q, want a", entry.Val)
+		}
+	})
+}
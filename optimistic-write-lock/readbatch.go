@@ -0,0 +1,138 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/dragonboat/v4"
+)
+
+// readBatcher coalesces the linearizable reads made concurrently on a node
+// behind a single ReadIndex request, each read then queries the local replica
+// with ReadLocalNode. A read only joins a batch whose ReadIndex hasn't been
+// requested yet, so the read index is always obtained after the read was
+// received and the reads stay linearizable.
+type readBatcher struct {
+	nh      *dragonboat.NodeHost
+	shardID uint64
+	mu      sync.Mutex
+	// next collects the reads received while the ReadIndex of the running
+	// batch is in flight
+	next    *readBatch
+	running bool
+}
+
+type readBatch struct {
+	// deadline is the latest deadline of the reads in the batch
+	deadline time.Time
+	done     chan struct{}
+	// rs is shared by all reads of the batch, it is returned to the pool of
+	// NodeHost once the batch completed and all reads released the batch
+	rs  *dragonboat.RequestState
+	err error
+	// refs counts the reads of the batch plus one for its run
+	refs int32
+}
+
+// release drops a reference to the batch, the last one releases rs.
+func (batch *readBatch) release() {
+	if atomic.AddInt32(&batch.refs, -1) == 0 && batch.rs != nil {
+		batch.rs.Release()
+	}
+}
+
+func newReadBatcher(nh *dragonboat.NodeHost, shardID uint64) *readBatcher {
+	return &readBatcher{nh: nh, shardID: shardID}
+}
+
+// read makes a linearizable read of query on the local replica.
+func (b *readBatcher) read(ctx context.Context, query interface{}) (interface{}, error) {
+	batch := b.join(ctx)
+	defer batch.release()
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if batch.err != nil {
+		return nil, batch.err
+	}
+	return b.nh.ReadLocalNode(batch.rs, query)
+}
+
+// join adds a read to the next batch, the batch is started right away when no
+// ReadIndex is in flight.
+func (b *readBatcher) join(ctx context.Context) *readBatch {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(maxTimeout)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.next == nil {
+		b.next = &readBatch{done: make(chan struct{}), refs: 1}
+	}
+	batch := b.next
+	atomic.AddInt32(&batch.refs, 1)
+	if deadline.After(batch.deadline) {
+		batch.deadline = deadline
+	}
+	if !b.running {
+		b.running = true
+		b.next = nil
+		go b.run(batch)
+	}
+	return batch
+}
+
+// run requests the read index of batch and of the batches that fill up in
+// the meantime, one at a time.
+func (b *readBatcher) run(batch *readBatch) {
+	for batch != nil {
+		batch.rs, batch.err = b.readIndex(batch.deadline)
+		close(batch.done)
+		batch.release()
+		b.mu.Lock()
+		batch, b.next = b.next, nil
+		b.running = batch != nil
+		b.mu.Unlock()
+	}
+}
+
+// readIndex waits for the local replica to apply the read index of the shard.
+func (b *readBatcher) readIndex(deadline time.Time) (*dragonboat.RequestState, error) {
+	rs, err := b.nh.ReadIndex(b.shardID, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	r := <-rs.ResultC()
+	switch {
+	case r.Completed():
+		return rs, nil
+	case r.Timeout():
+		return nil, dragonboat.ErrTimeout
+	case r.Rejected():
+		return nil, dragonboat.ErrRejected
+	case r.Terminated():
+		return nil, dragonboat.ErrShardClosed
+	case r.Dropped():
+		return nil, dragonboat.ErrShardNotReady
+	}
+	return nil, dragonboat.ErrAborted
+}
@@ -0,0 +1,248 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/lni/dragonboat/v4"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	"github.com/lni/dragonboat/v4/tools"
+)
+
+const (
+	// snapshotMetadataFilename is the file of an exported snapshot holding its
+	// metadata, a checksum followed by the encoded raftpb.Snapshot
+	snapshotMetadataFilename = "snapshot.metadata"
+	metadataChecksumSize     = 8
+)
+
+// snapshotDirRe matches the directories of completed exported snapshots,
+// snapshots still being written have a suffix.
+var snapshotDirRe = regexp.MustCompile(`^snapshot-[0-9A-F]+$`)
+
+// SnapshotResult is the response to a snapshot request. Path is the directory
+// the snapshot was exported to, it is empty when the snapshot wasn't exported.
+type SnapshotResult struct {
+	Index uint64 `json:"index"`
+	Path  string `json:"path,omitempty"`
+}
+
+// ExportedSnapshot describes a snapshot exported by the node.
+type ExportedSnapshot struct {
+	ShardID uint64 `json:"shard_id"`
+	Index   uint64 `json:"index"`
+	Term    uint64 `json:"term"`
+	Size    uint64 `json:"size"`
+	Path    string `json:"path"`
+	// Members are the replicas of the shard when the snapshot was taken
+	Members map[uint64]string `json:"members"`
+}
+
+// exportDir returns the directory the snapshots of a shard are exported to.
+func (o nodeOptions) exportDir(shardID uint64) string {
+	return filepath.Join(o.dir, "exported", fmt.Sprint(shardID))
+}
+
+// fsmDir returns the directory the on disk state machines of the node are
+// stored in.
+func (o nodeOptions) fsmDir() string {
+	return filepath.Join(o.dir, "fsm")
+}
+
+// snapshots serves the snapshot admin endpoints, they are served by the node
+// receiving the request -
+// GET /admin/snapshots lists the snapshots exported by the node
+// POST /admin/snapshots requests a snapshot of the local replica, it is
+// exported when export=true
+func (h *handler) snapshots(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(ctx, w, r) {
+		return
+	}
+	if r.Method == "GET" {
+		snapshots, err := listExportedSnapshots(h.exportDir)
+		if err != nil {
+			writeError(w, 500, ErrorCodeInternal, err.Error())
+			return
+		}
+		b, _ := json.Marshal(snapshots)
+		w.WriteHeader(200)
+		w.Write(b)
+		return
+	}
+	if r.Method != "POST" {
+		writeError(w, 405, ErrorCodeMethodNotAllowed, "Method not supported")
+		return
+	}
+	var opt dragonboat.SnapshotOption
+	if r.URL.Query().Get("export") == "true" {
+		if err := os.MkdirAll(h.exportDir, 0755); err != nil {
+			writeError(w, 500, ErrorCodeInternal, err.Error())
+			return
+		}
+		opt = dragonboat.SnapshotOption{Exported: true, ExportPath: h.exportDir}
+	}
+	index, err := h.nh.SyncRequestSnapshot(ctx, h.shardID, opt)
+	if errors.Is(err, dragonboat.ErrRejected) {
+		// retrying doesn't help until more entries are applied
+		writeError(w, 412, ErrorCodePreconditionFailed, "A snapshot was already taken at the applied index")
+		return
+	} else if err != nil {
+		writeRaftError(w, err)
+		return
+	}
+	res := SnapshotResult{Index: index}
+	if opt.Exported {
+		res.Path = filepath.Join(h.exportDir, fmt.Sprintf("snapshot-%016X", index))
+	}
+	b, _ := json.Marshal(res)
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+// listExportedSnapshots returns the completed snapshots exported to dir
+// ordered by index.
+func listExportedSnapshots(dir string) ([]ExportedSnapshot, error) {
+	snapshots := []ExportedSnapshot{}
+	files, err := ioutil.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return snapshots, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if !fi.IsDir() || !snapshotDirRe.MatchString(fi.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		ss, err := readSnapshotMetadata(path)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, ExportedSnapshot{
+			ShardID: ss.ShardID,
+			Index:   ss.Index,
+			Term:    ss.Term,
+			Size:    ss.FileSize,
+			Path:    path,
+			Members: ss.Membership.Addresses,
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Index < snapshots[j].Index })
+	return snapshots, nil
+}
+
+// readSnapshotMetadata reads the metadata of the snapshot exported to dir.
+func readSnapshotMetadata(dir string) (pb.Snapshot, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, snapshotMetadataFilename))
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	if len(data) < metadataChecksumSize {
+		return pb.Snapshot{}, fmt.Errorf("corrupted snapshot metadata in %s", dir)
+	}
+	sum := md5.Sum(data[metadataChecksumSize:])
+	if !bytes.Equal(data[:metadataChecksumSize], sum[metadataChecksumSize:]) {
+		return pb.Snapshot{}, fmt.Errorf("corrupted snapshot metadata in %s", dir)
+	}
+	var ss pb.Snapshot
+	if err := ss.Unmarshal(data[metadataChecksumSize:]); err != nil {
+		return pb.Snapshot{}, err
+	}
+	return ss, nil
+}
+
+// importSnapshot replaces the state of the stopped node's replica with the
+// snapshot exported to dir, the shard restarts with members as its
+// membership. The database of the on disk state machine of the replica is
+// removed as well, NodeHost recovers the imported snapshot even though the
+// database is ahead of it, but the database would otherwise be opened on the
+// restart only to be replaced.
+func importSnapshot(opts nodeOptions, dir string, members map[uint64]string) error {
+	ss, err := readSnapshotMetadata(dir)
+	if err != nil {
+		return err
+	}
+	if err := tools.ImportSnapshot(nodeHostConfig(opts), dir, members, opts.replicaID); err != nil {
+		return err
+	}
+	return os.RemoveAll(onDiskReplicaDir(opts.fsmDir(), ss.ShardID, opts.replicaID))
+}
+
+// importMain implements the import subcommand, it replaces the state of a
+// stopped node's replica with an exported snapshot. The subcommand is run on
+// each node of the new membership with the same snapshot and peers, the
+// shard then restarts from the snapshot with the given peers as its members.
+// Replicas not in peers must never be restarted.
+func importMain(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	snapshot := fs.String("snapshot", "", "Directory of the exported snapshot")
+	replicaID := fs.Uint64("replicaid", 0, "ReplicaID of the node to import the snapshot on")
+	raftAddr := fs.String("raft-addr", "", "Raft address of the node, defaults to its address in peers")
+	peersFlag := fs.String("peers", "",
+		"Comma separated <replicaID>=<raft-addr> list of the replicas of the shard after the import")
+	datadir := fs.String("datadir", "/tmp/dragonboat-example-linearizable",
+		"Directory the node data is stored in")
+	var tlsOpts tlsOptions
+	tlsOpts.registerFlags(fs)
+	fs.Parse(args)
+	if err := tlsOpts.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	peers := defaultPeers()
+	if len(*peersFlag) > 0 {
+		var err error
+		if peers, err = parsePeers(*peersFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	p, ok := peers[*replicaID]
+	if len(*snapshot) == 0 || !ok {
+		fmt.Fprintf(os.Stderr, "-snapshot and a -replicaid in peers are required\n")
+		os.Exit(1)
+	}
+	if len(*raftAddr) == 0 {
+		*raftAddr = p.raftAddr
+	}
+	members := make(map[uint64]string)
+	for id, p := range peers {
+		members[id] = p.raftAddr
+	}
+	opts := nodeOptions{
+		replicaID: *replicaID,
+		raftAddr:  *raftAddr,
+		dir:       fmt.Sprintf("%s/%d", *datadir, *replicaID),
+		tls:       tlsOpts,
+	}
+	if err := importSnapshot(opts, *snapshot, members); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to import the snapshot, %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "snapshot %s imported on replica %d\n", *snapshot, *replicaID)
+}
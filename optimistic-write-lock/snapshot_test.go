@@ -0,0 +1,208 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// writeSnapshotMetadata writes the metadata file of ss in the format of
+// exported snapshots to the directory of its index in dir.
+func writeSnapshotMetadata(t *testing.T, dir string, ss pb.Snapshot) string {
+	data, err := ss.Marshal()
+	if err != nil {
+		t.Fatalf("failed to encode the snapshot metadata, %v", err)
+	}
+	sum := md5.Sum(data)
+	path := filepath.Join(dir, fmt.Sprintf("snapshot-%016X", ss.Index))
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatalf("failed to create the snapshot directory, %v", err)
+	}
+	data = append(sum[metadataChecksumSize:], data...)
+	if err := ioutil.WriteFile(filepath.Join(path, snapshotMetadataFilename), data, 0644); err != nil {
+		t.Fatalf("failed to write the snapshot metadata, %v", err)
+	}
+	return path
+}
+
+func testSnapshot(index uint64) pb.Snapshot {
+	return pb.Snapshot{
+		ShardID:  shardID,
+		Index:    index,
+		Term:     2,
+		FileSize: 1024,
+		Membership: pb.Membership{
+			Addresses: map[uint64]string{1: "localhost:63001", 2: "localhost:63002"},
+		},
+	}
+}
+
+func TestReadSnapshotMetadata(t *testing.T) {
+	dir := t.TempDir()
+	want := testSnapshot(10)
+	path := writeSnapshotMetadata(t, dir, want)
+	got, err := readSnapshotMetadata(path)
+	if err != nil {
+		t.Fatalf("failed to read the snapshot metadata, %v", err)
+	}
+	if got.ShardID != want.ShardID || got.Index != want.Index || got.Term != want.Term ||
+		got.FileSize != want.FileSize || !reflect.DeepEqual(got.Membership.Addresses, want.Membership.Addresses) {
+		t.Errorf("read %+v, want %+v", got, want)
+	}
+	file := filepath.Join(path, snapshotMetadataFilename)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed to read the snapshot metadata file, %v", err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"shorter than the checksum", data[:metadataChecksumSize-1]},
+		{"corrupted checksum", append([]byte{data[0] ^ 0xFF}, data[1:]...)},
+		{"corrupted metadata", append(append([]byte{}, data[:len(data)-1]...), data[len(data)-1]^0xFF)},
+		{"truncated metadata", data[:len(data)-1]},
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(file, tt.data, 0644); err != nil {
+			t.Fatalf("failed to write the snapshot metadata file, %v", err)
+		}
+		if _, err := readSnapshotMetadata(path); err == nil {
+			t.Errorf("%s: metadata read without error", tt.name)
+		}
+	}
+	if _, err := readSnapshotMetadata(dir); !os.IsNotExist(err) {
+		t.Errorf("read of a directory without metadata returned %v", err)
+	}
+}
+
+func TestListExportedSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	snapshots, err := listExportedSnapshots(filepath.Join(dir, "missing"))
+	if err != nil || len(snapshots) != 0 {
+		t.Fatalf("missing directory listed %v, %v", snapshots, err)
+	}
+	for _, index := range []uint64{300, 20, 1000} {
+		writeSnapshotMetadata(t, dir, testSnapshot(index))
+	}
+	// snapshots still being written, other directories and files are ignored
+	for _, name := range []string{"snapshot-0000000000000400.generating", "other"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatalf("failed to create %s, %v", name, err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "snapshot-0000000000000500"), nil, 0644); err != nil {
+		t.Fatalf("failed to write the file, %v", err)
+	}
+	snapshots, err = listExportedSnapshots(dir)
+	if err != nil {
+		t.Fatalf("failed to list the snapshots, %v", err)
+	}
+	var indexes []uint64
+	for _, ss := range snapshots {
+		indexes = append(indexes, ss.Index)
+		if want := filepath.Join(dir, fmt.Sprintf("snapshot-%016X", ss.Index)); ss.Path != want {
+			t.Errorf("snapshot path is %s, want %s", ss.Path, want)
+		}
+		if ss.ShardID != shardID || ss.Size != 1024 || len(ss.Members) != 2 {
+			t.Errorf("snapshot is %+v", ss)
+		}
+	}
+	if !reflect.DeepEqual(indexes, []uint64{20, 300, 1000}) {
+		t.Errorf("listed indexes %v, want [20 300 1000]", indexes)
+	}
+	// a corrupted snapshot fails the listing
+	writeSnapshotMetadata(t, dir, testSnapshot(2000))
+	file := filepath.Join(dir, fmt.Sprintf("snapshot-%016X", 2000), snapshotMetadataFilename)
+	if err := ioutil.WriteFile(file, []byte("corrupted"), 0644); err != nil {
+		t.Fatalf("failed to corrupt the snapshot metadata, %v", err)
+	}
+	if _, err := listExportedSnapshots(dir); err == nil {
+		t.Errorf("corrupted snapshot listed without error")
+	}
+}
+
+func TestImportOnDiskSnapshot(t *testing.T) {
+	addrs := freeAddrs(t, 2)
+	opts := nodeOptions{
+		replicaID: 1,
+		raftAddr:  addrs[0],
+		httpAddr:  addrs[1],
+		dir:       filepath.Join(t.TempDir(), "1"),
+		peers:     map[uint64]peer{1: {raftAddr: addrs[0], httpAddr: addrs[1]}},
+		storage:   StorageDisk,
+	}
+	url := "http://" + addrs[1]
+	client := &http.Client{Timeout: 5 * time.Second}
+	do := func(method, path string, v interface{}) {
+		req, err := http.NewRequest(method, url+path, nil)
+		if err != nil {
+			t.Fatalf("failed to create the request, %v", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed, %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("%s %s returned %d", method, path, resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("failed to decode the response of %s %s, %v", method, path, err)
+		}
+	}
+	n, err := startNode(opts)
+	if err != nil {
+		t.Fatalf("failed to start the node, %v", err)
+	}
+	waitForLeader(t, client, url)
+	var entry Entry
+	do("PUT", "/a?val=1", &entry)
+	var exported struct {
+		Path string `json:"path"`
+	}
+	do("POST", "/admin/snapshots?export=true", &exported)
+	do("PUT", fmt.Sprintf("/a?val=2&ver=%d", entry.Ver), &entry)
+	shutdown([]*node{n}, time.Second)
+
+	if err := importSnapshot(opts, exported.Path, map[uint64]string{1: addrs[0]}); err != nil {
+		t.Fatalf("failed to import the snapshot, %v", err)
+	}
+	if _, err := os.Stat(onDiskReplicaDir(opts.fsmDir(), shardID, 1)); !os.IsNotExist(err) {
+		t.Errorf("the database of the replica wasn't removed, %v", err)
+	}
+	if n, err = startNode(opts); err != nil {
+		t.Fatalf("failed to restart the node, %v", err)
+	}
+	defer shutdown([]*node{n}, time.Second)
+	waitForLeader(t, client, url)
+	// the state machine restarted from the snapshot rather than its database
+	do("GET", "/a", &entry)
+	if entry.Val != "1" {
+		t.Errorf("got %+v after the import, want the value of the snapshot", entry)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// store holds the entries and the history of the state machine. The state
+// machine logic only accesses its data through a store, so the in memory and
+// the on disk state machines apply commands the same way.
+type store interface {
+	get(key string) (Entry, bool)
+	set(entry Entry)
+	remove(key string)
+	// scan calls f with the entries in key order starting at key start until
+	// f returns false.
+	scan(start string, f func(Entry) bool)
+	// revisions returns the prior versions of key oldest first.
+	revisions(key string) []Revision
+	// setRevisions replaces the prior versions of key, an empty list removes
+	// them.
+	setRevisions(key string, versions []Revision)
+	// scanHistory calls f with the prior versions of each key in key order
+	// until f returns false.
+	scanHistory(f func(key string, versions []Revision) bool)
+	// pushExpiry adds ref to the expiry queue, refs are pushed in the order of
+	// their replaced times.
+	pushExpiry(ref historyRef)
+	// popExpired removes the refs replaced before cutoff from the expiry
+	// queue and returns them.
+	popExpired(cutoff int64) []historyRef
+}
+
+// memoryStore is the store of the in memory state machine.
+type memoryStore struct {
+	data map[string]Entry
+	// keys is the sorted index of all keys in data
+	keys    []string
+	history map[string][]Revision
+	// expiry references the prior versions in the order they were replaced
+	expiry []historyRef
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		data:    map[string]Entry{},
+		history: map[string][]Revision{},
+	}
+}
+
+func (s *memoryStore) get(key string) (Entry, bool) {
+	entry, ok := s.data[key]
+	return entry, ok
+}
+
+// set stores entry and adds new keys to the sorted index.
+func (s *memoryStore) set(entry Entry) {
+	if _, ok := s.data[entry.Key]; !ok {
+		i := sort.SearchStrings(s.keys, entry.Key)
+		s.keys = append(s.keys, "")
+		copy(s.keys[i+1:], s.keys[i:])
+		s.keys[i] = entry.Key
+	}
+	s.data[entry.Key] = entry
+}
+
+// remove deletes key from both the data and the sorted index.
+func (s *memoryStore) remove(key string) {
+	if _, ok := s.data[key]; !ok {
+		return
+	}
+	i := sort.SearchStrings(s.keys, key)
+	s.keys = append(s.keys[:i], s.keys[i+1:]...)
+	delete(s.data, key)
+}
+
+func (s *memoryStore) scan(start string, f func(Entry) bool) {
+	for i := sort.SearchStrings(s.keys, start); i < len(s.keys); i++ {
+		if !f(s.data[s.keys[i]]) {
+			return
+		}
+	}
+}
+
+func (s *memoryStore) revisions(key string) []Revision {
+	return s.history[key]
+}
+
+func (s *memoryStore) setRevisions(key string, versions []Revision) {
+	if len(versions) == 0 {
+		delete(s.history, key)
+	} else {
+		s.history[key] = versions
+	}
+}
+
+func (s *memoryStore) scanHistory(f func(key string, versions []Revision) bool) {
+	keys := make([]string, 0, len(s.history))
+	for key := range s.history {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !f(key, s.history[key]) {
+			return
+		}
+	}
+}
+
+func (s *memoryStore) pushExpiry(ref historyRef) {
+	s.expiry = append(s.expiry, ref)
+}
+
+func (s *memoryStore) popExpired(cutoff int64) []historyRef {
+	i := sort.Search(len(s.expiry), func(i int) bool { return s.expiry[i].replaced >= cutoff })
+	refs := s.expiry[:i]
+	s.expiry = s.expiry[i:]
+	return refs
+}
+
+// writeSnapshot encodes the entries of s followed by its history, with the
+// state machine clock, and meta. The entries and the history are streamed as
+// JSON objects keyed by key, the snapshots of the in memory and the on disk
+// state machines are the same.
+func writeSnapshot(w io.Writer, s store, now int64, meta snapshotMeta) error {
+	// errors of the buffered writer are sticky, they are returned by Flush
+	bw := bufio.NewWriter(w)
+	write := func(v interface{}) {
+		b, _ := json.Marshal(v)
+		bw.Write(b)
+	}
+	bw.WriteByte('{')
+	first := true
+	s.scan("", func(entry Entry) bool {
+		if !first {
+			bw.WriteByte(',')
+		}
+		first = false
+		write(entry.Key)
+		bw.WriteByte(':')
+		write(entry)
+		return true
+	})
+	bw.WriteString("}\n{\"history\":{")
+	first = true
+	s.scanHistory(func(key string, versions []Revision) bool {
+		if !first {
+			bw.WriteByte(',')
+		}
+		first = false
+		write(key)
+		bw.WriteByte(':')
+		write(versions)
+		return true
+	})
+	bw.WriteString("},\"now\":")
+	write(now)
+	bw.WriteString("}\n")
+	write(meta)
+	return bw.Flush()
+}
+
+// readSnapshot decodes a snapshot written by writeSnapshot into the empty
+// store s, it returns the state machine clock and the snapshot meta. Older
+// snapshots only hold the entries or the entries and the history, a snapshot
+// ending before its entries were read is truncated.
+func readSnapshot(r io.Reader, s store) (now int64, meta snapshotMeta, err error) {
+	dec := json.NewDecoder(r)
+	err = readObject(dec, func(key string) error {
+		var entry Entry
+		if err := dec.Decode(&entry); err != nil {
+			return err
+		}
+		s.set(entry)
+		return nil
+	})
+	if err != nil {
+		err = unexpectedEOF(err)
+		return
+	}
+	err = readObject(dec, func(field string) error {
+		switch field {
+		case "history":
+			return readObject(dec, func(key string) error {
+				var versions []Revision
+				if err := dec.Decode(&versions); err != nil {
+					return err
+				}
+				s.setRevisions(key, versions)
+				return nil
+			})
+		case "now":
+			return dec.Decode(&now)
+		}
+		var skipped json.RawMessage
+		return dec.Decode(&skipped)
+	})
+	if err == nil {
+		err = dec.Decode(&meta)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// readObject calls f with each member name of the next JSON object in dec, f
+// decodes the member value. A null value is read as an empty object, io.EOF is
+// only returned when dec ends before the object.
+func readObject(dec *json.Decoder, f func(name string) error) error {
+	tok, err := dec.Token()
+	if err != nil || tok == nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return fmt.Errorf("Invalid snapshot, expected an object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err == nil {
+			err = f(tok.(string))
+		}
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+	_, err = dec.Token()
+	return unexpectedEOF(err)
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF for io.EOF, the snapshot ended in
+// the middle of a value.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
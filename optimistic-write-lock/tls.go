@@ -0,0 +1,193 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tlsOptions holds the certificate files used by a node. Mutual TLS is used
+// for the Raft transport when caFile, certFile and keyFile are all set, the
+// HTTP API is served over TLS when httpCertFile and httpKeyFile are set.
+type tlsOptions struct {
+	caFile       string
+	certFile     string
+	keyFile      string
+	httpCertFile string
+	httpKeyFile  string
+}
+
+// registerFlags registers the flags setting the certificate files on fs.
+func (o *tlsOptions) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.caFile, "ca-file", "",
+		"CA certificate file, enables mutual TLS for the Raft transport together with -cert-file and -key-file")
+	fs.StringVar(&o.certFile, "cert-file", "", "Certificate file of the Raft transport")
+	fs.StringVar(&o.keyFile, "key-file", "", "Key file of the Raft transport")
+	fs.StringVar(&o.httpCertFile, "http-cert-file", "",
+		"Certificate file, enables TLS for the HTTP API together with -http-key-file")
+	fs.StringVar(&o.httpKeyFile, "http-key-file", "", "Key file of the HTTP API")
+}
+
+func (o tlsOptions) mutualTLS() bool {
+	return len(o.caFile) > 0 && len(o.certFile) > 0 && len(o.keyFile) > 0
+}
+
+func (o tlsOptions) httpTLS() bool {
+	return len(o.httpCertFile) > 0 && len(o.httpKeyFile) > 0
+}
+
+func (o tlsOptions) validate() error {
+	if (len(o.caFile) > 0 || len(o.certFile) > 0 || len(o.keyFile) > 0) && !o.mutualTLS() {
+		return errors.New("-ca-file, -cert-file and -key-file must be set together")
+	}
+	if (len(o.httpCertFile) > 0 || len(o.httpKeyFile) > 0) && !o.httpTLS() {
+		return errors.New("-http-cert-file and -http-key-file must be set together")
+	}
+	return nil
+}
+
+// httpTransport returns the transport used to forward requests to other
+// nodes, it trusts the CA in caFile when set.
+func (o tlsOptions) httpTransport() (http.RoundTripper, error) {
+	if !o.httpTLS() || len(o.caFile) == 0 {
+		return nil, nil
+	}
+	pool, err := loadCertPool(o.caFile)
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return t, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// genCertsMain implements the gencerts subcommand.
+func genCertsMain(args []string) {
+	fs := flag.NewFlagSet("gencerts", flag.ExitOnError)
+	dir := fs.String("dir", "certs", "Directory to write the certificates to")
+	nodes := fs.Int("nodes", 3, "Number of node certificates to generate")
+	hosts := fs.String("hosts", "localhost,127.0.0.1",
+		"Comma separated host names and IP addresses the node certificates are valid for")
+	fs.Parse(args)
+	if err := generateCerts(*dir, *nodes, strings.Split(*hosts, ",")); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to generate certificates, %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "certificates written to %s\n", *dir)
+}
+
+// generateCerts writes a self-signed test CA to ca.crt and ca.key in dir and
+// node certificates signed by it to node<N>.crt and node<N>.key. The node
+// certificates can be used as both server and client certificates. They are
+// for local testing only.
+func generateCerts(dir string, nodes int, hosts []string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dragonboat example test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	if err := writeCert(dir, "ca", caDER, caKey); err != nil {
+		return err
+	}
+	for i := 1; i <= nodes; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		cert := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 1)),
+			Subject:      pkix.Name{CommonName: fmt.Sprintf("node%d", i)},
+			NotBefore:    ca.NotBefore,
+			NotAfter:     ca.NotAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		for _, h := range hosts {
+			if h = strings.TrimSpace(h); len(h) == 0 {
+				continue
+			}
+			if ip := net.ParseIP(h); ip != nil {
+				cert.IPAddresses = append(cert.IPAddresses, ip)
+			} else {
+				cert.DNSNames = append(cert.DNSNames, h)
+			}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		if err := writeCert(dir, fmt.Sprintf("node%d", i), der, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCert(dir string, name string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600)
+}
@@ -0,0 +1,129 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freeAddrs returns n distinct localhost addresses that were free when
+// checked.
+func freeAddrs(t testing.TB, n int) []string {
+	var addrs []string
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("failed to find a free port, %v", err)
+		}
+		defer l.Close()
+		addrs = append(addrs, fmt.Sprintf("localhost:%d", l.Addr().(*net.TCPAddr).Port))
+	}
+	return addrs
+}
+
+func TestMutualTLSCluster(t *testing.T) {
+	dir := t.TempDir()
+	certDir := filepath.Join(dir, "certs")
+	if err := generateCerts(certDir, 3, []string{"localhost", "127.0.0.1"}); err != nil {
+		t.Fatalf("failed to generate certificates, %v", err)
+	}
+	addrs := freeAddrs(t, 6)
+	peers := make(map[uint64]peer)
+	for i := uint64(1); i <= 3; i++ {
+		peers[i] = peer{raftAddr: addrs[i-1], httpAddr: addrs[i+2]}
+	}
+	var nodes []*node
+	defer func() {
+		shutdown(nodes, time.Second)
+	}()
+	for i := uint64(1); i <= 3; i++ {
+		node := filepath.Join(certDir, fmt.Sprintf("node%d", i))
+		n, err := startNode(nodeOptions{
+			replicaID: i,
+			raftAddr:  peers[i].raftAddr,
+			httpAddr:  peers[i].httpAddr,
+			dir:       filepath.Join(dir, fmt.Sprintf("%d", i)),
+			forward:   ForwardModeProxy,
+			peers:     peers,
+			tls: tlsOptions{
+				caFile:       filepath.Join(certDir, "ca.crt"),
+				certFile:     node + ".crt",
+				keyFile:      node + ".key",
+				httpCertFile: node + ".crt",
+				httpKeyFile:  node + ".key",
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to start node %d, %v", i, err)
+		}
+		nodes = append(nodes, n)
+	}
+	pool, err := loadCertPool(filepath.Join(certDir, "ca.crt"))
+	if err != nil {
+		t.Fatalf("failed to load CA, %v", err)
+	}
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	do := func(method string, url string) (int, string, error) {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			return 0, "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(b)), err
+	}
+	// the put succeeds once a leader has been elected over the mTLS transport
+	var code int
+	var body string
+	for deadline := time.Now().Add(20 * time.Second); time.Now().Before(deadline); {
+		code, body, err = do("PUT", "https://"+peers[2].httpAddr+"/tls?val=secure")
+		if err == nil && code == 200 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if code != 200 {
+		t.Fatalf("put failed, code %d, body %q, err %v", code, body, err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		code, body, err := do("GET", "https://"+peers[i].httpAddr+"/tls")
+		if err != nil || code != 200 || !strings.Contains(body, `"val":"secure"`) {
+			t.Errorf("get from node %d failed, code %d, body %q, err %v", i, code, body, err)
+		}
+	}
+	// TLS servers answer plain HTTP requests with 400
+	resp, err := http.Get("http://" + peers[1].httpAddr + "/tls")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == 200 {
+			t.Errorf("plain HTTP request unexpectedly served")
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	maxKeyLength = 1024
+	maxValueSize = 1 << 20
+	maxTxnOps    = 128
+)
+
+// validateKey returns an error when key can't be used by clients.
+func validateKey(key string) error {
+	if len(key) == 0 {
+		return fmt.Errorf("Missing key")
+	}
+	if len(key) > maxKeyLength {
+		return fmt.Errorf("Key is longer than %d bytes", maxKeyLength)
+	}
+	if isReserved(key) {
+		return fmt.Errorf("Key %q is in a reserved key space", key)
+	}
+	return nil
+}
+
+func validateValue(val string) error {
+	if len(val) > maxValueSize {
+		return fmt.Errorf("Value is larger than %d bytes", maxValueSize)
+	}
+	return nil
+}
+
+// validate checks the limits of cmd. Commands are validated by the handlers
+// before they are proposed, and again by the state machine as proposals may
+// come from other clients or older versions. The check only depends on the
+// command so all replicas reject the same entries.
+func (cmd *Command) validate() error {
+	switch cmd.Type {
+	case CommandTypePut:
+		if err := validateKey(cmd.Key); err != nil {
+			return err
+		}
+		return validateValue(cmd.Val)
+	case CommandTypeDelete, CommandTypeRevert:
+		return validateKey(cmd.Key)
+	case CommandTypePatch:
+		if err := validateKey(cmd.Key); err != nil {
+			return err
+		}
+		if err := validateValue(cmd.Val); err != nil {
+			return err
+		}
+		return cmd.Patch.validate(cmd.Val)
+	case CommandTypeLock, CommandTypeRenew, CommandTypeUnlock:
+		if err := validateLockName(cmd.Key); err != nil {
+			return err
+		}
+		if cmd.Time <= 0 {
+			return fmt.Errorf("Missing proposal time")
+		}
+		if err := validateLockOwner(cmd.Val); err != nil {
+			return err
+		}
+		if cmd.Type == CommandTypeLock {
+			return validateTTL(cmd.TTL)
+		} else if cmd.Type == CommandTypeRenew && cmd.TTL != 0 {
+			return validateTTL(cmd.TTL)
+		}
+		return nil
+	case CommandTypeTxn:
+		return cmd.Txn.validate()
+	case CommandTypeSetPrincipal:
+		return validateValue(cmd.Val)
+	case CommandTypeDeletePrincipal:
+		return nil
+	case CommandTypeCreateNamespace:
+		return validateNamespace(cmd.Key)
+	}
+	return fmt.Errorf("Unknown command type %q", cmd.Type)
+}
@@ -0,0 +1,206 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	EventTypePut    = "put"
+	EventTypeDelete = "delete"
+)
+
+const (
+	// watcherBuffer is the number of events a watcher can fall behind before
+	// it is dropped
+	watcherBuffer = 1024
+	// eventLogSize is the minimum number of recent events kept for replay
+	eventLogSize = 4096
+)
+
+var (
+	ErrWatcherLagging = errors.New("Watcher fell behind")
+	ErrWatchClosed    = errors.New("Watch closed")
+	// ErrCompacted is returned when the events to replay are no longer in the
+	// event log, the watcher has to resync.
+	ErrCompacted = errors.New("Events were compacted, resync")
+)
+
+// Event is a change of a key applied by the local replica. Entry is the new
+// entry of a put and the removed entry of a delete.
+type Event struct {
+	Type  string `json:"type"`
+	Entry Entry  `json:"entry"`
+	Index uint64 `json:"index"`
+}
+
+// WatchQuery returns the principal owning Token, its permissions are used to
+// filter the events delivered to a watcher.
+type WatchQuery struct {
+	Token string
+}
+
+// watchHub delivers the changes applied by the state machine to the watchers
+// of the local replica. The most recent events are kept in a bounded log so
+// watchers can resume from an earlier index.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+	closed   bool
+	// log holds all events with an index greater than since
+	log   []Event
+	since uint64
+}
+
+type watcher struct {
+	prefix    string
+	principal Principal
+	ch        chan Event
+	// err is the reason the watcher was dropped, it is set before ch is closed
+	err error
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watchers: map[*watcher]struct{}{}}
+}
+
+// subscribe registers a watcher of the keys starting with prefix the principal
+// is allowed to read, it receives the events applied from now on.
+func (h *watchHub) subscribe(prefix string, p Principal) (*watcher, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrWatchClosed
+	}
+	w := &watcher{prefix: prefix, principal: p, ch: make(chan Event, watcherBuffer)}
+	h.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// subscribeAfter registers a watcher like subscribe and replays the logged
+// events with an index greater than after. ErrCompacted is returned when some
+// of these events are no longer logged.
+func (h *watchHub) subscribeAfter(prefix string, p Principal, after uint64) (*watcher, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrWatchClosed
+	}
+	if after < h.since {
+		return nil, ErrCompacted
+	}
+	var replay []Event
+	for _, e := range h.log {
+		if e.Index > after && matches(prefix, p, e) {
+			replay = append(replay, e)
+		}
+	}
+	w := &watcher{prefix: prefix, principal: p, ch: make(chan Event, watcherBuffer+len(replay))}
+	for _, e := range replay {
+		w.ch <- e
+	}
+	h.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// latest returns the index of the most recent event published, or of the
+// snapshot the log starts after when no event was published since.
+func (h *watchHub) latest() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.log) > 0 {
+		return h.log[len(h.log)-1].Index
+	}
+	return h.since
+}
+
+func (h *watchHub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.watchers[w]; ok {
+		delete(h.watchers, w)
+		close(w.ch)
+	}
+}
+
+// publish never blocks the state machine, watchers that can't keep up are
+// dropped.
+func (h *watchHub) publish(events []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// the log is trimmed back to its size once it doubled so events aren't
+	// moved on every publish
+	h.log = append(h.log, events...)
+	if len(h.log) > 2*eventLogSize {
+		n := len(h.log) - eventLogSize
+		h.since = h.log[n-1].Index
+		h.log = append(h.log[:0], h.log[n:]...)
+	}
+	for w := range h.watchers {
+		for _, e := range events {
+			if !matches(w.prefix, w.principal, e) {
+				continue
+			}
+			select {
+			case w.ch <- e:
+			default:
+				w.err = ErrWatcherLagging
+				delete(h.watchers, w)
+				close(w.ch)
+			}
+			if w.err != nil {
+				break
+			}
+		}
+	}
+}
+
+// matches returns whether e is delivered to a watcher of prefix.
+func matches(prefix string, p Principal, e Event) bool {
+	return strings.HasPrefix(e.Entry.Key, prefix) && p.allowed(e.Entry.Key, false)
+}
+
+// reset drops all watchers and clears the log. It is called when the state
+// machine is recovered from the snapshot taken at index since, as the changes
+// included in the snapshot can't be delivered.
+func (h *watchHub) reset(since uint64) {
+	h.mu.Lock()
+	h.log = nil
+	h.since = since
+	h.mu.Unlock()
+	h.drop(ErrWatcherLagging)
+}
+
+// drop drops all watchers.
+func (h *watchHub) drop(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		w.err = err
+		delete(h.watchers, w)
+		close(w.ch)
+	}
+}
+
+// close drops all watchers and rejects new ones, it is called on shutdown.
+func (h *watchHub) close() {
+	h.mu.Lock()
+	h.closed = true
+	h.mu.Unlock()
+	h.drop(ErrWatchClosed)
+}
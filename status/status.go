@@ -0,0 +1,175 @@
+// Copyright 2017,2018 Lei Ni (nilei81@gmail.com).
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package status provides the health, readiness and status HTTP endpoints shared
+by the example programs.
+*/
+package status
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lni/dragonboat/v4"
+)
+
+const (
+	defaultReadyTimeout = time.Second
+)
+
+// Handler serves the following endpoints for a NodeHost -
+// /healthz returns 200 as long as the NodeHost is running
+// /readyz returns 200 when every shard on the NodeHost has a leader and the
+// local replica has applied all entries up to the shard's read index, witness
+// replicas only need a leader
+// /status returns the state of the NodeHost and its shards as JSON
+// Requests are matched on the path suffix so the endpoints can be mounted
+// under any prefix.
+type Handler struct {
+	NodeHost *dragonboat.NodeHost
+	// AppliedIndex optionally returns the index of the last entry applied to
+	// the local replica of the shard, it is included in the status when set.
+	AppliedIndex func(shardID uint64) (uint64, error)
+	// ReadyTimeout is how long the readiness check waits for the read index,
+	// one second is used when it is 0.
+	ReadyTimeout time.Duration
+}
+
+// ShardStatus is the status of a local replica.
+type ShardStatus struct {
+	ShardID           uint64            `json:"shard_id"`
+	ReplicaID         uint64            `json:"replica_id"`
+	LeaderID          uint64            `json:"leader_id"`
+	Term              uint64            `json:"term"`
+	IsLeader          bool              `json:"is_leader"`
+	IsNonVoting       bool              `json:"is_non_voting"`
+	IsWitness         bool              `json:"is_witness"`
+	Pending           bool              `json:"pending"`
+	ConfigChangeIndex uint64            `json:"config_change_index"`
+	Members           map[uint64]string `json:"members"`
+	FirstIndex        uint64            `json:"first_index"`
+	LastIndex         uint64            `json:"last_index"`
+	AppliedIndex      *uint64           `json:"applied_index,omitempty"`
+}
+
+// Status is the status of a NodeHost.
+type Status struct {
+	NodeHostID  string        `json:"nodehost_id"`
+	RaftAddress string        `json:"raft_address"`
+	Shards      []ShardStatus `json:"shards"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		w.Write([]byte("Method not supported"))
+		return
+	}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/healthz"):
+		w.WriteHeader(200)
+		w.Write([]byte("ok"))
+	case strings.HasSuffix(r.URL.Path, "/readyz"):
+		if err := h.Ready(); err != nil {
+			w.WriteHeader(503)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(200)
+		w.Write([]byte("ok"))
+	case strings.HasSuffix(r.URL.Path, "/status"):
+		b, _ := json.Marshal(h.Status())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(b)
+	default:
+		w.WriteHeader(404)
+		w.Write([]byte("Not Found"))
+	}
+}
+
+// Status returns the status of the NodeHost and its shards.
+func (h *Handler) Status() Status {
+	info := h.NodeHost.GetNodeHostInfo(dragonboat.NodeHostInfoOption{SkipLogInfo: true})
+	s := Status{
+		NodeHostID:  info.NodeHostID,
+		RaftAddress: info.RaftAddress,
+		Shards:      []ShardStatus{},
+	}
+	for _, ci := range info.ShardInfoList {
+		ss := ShardStatus{
+			ShardID:           ci.ShardID,
+			ReplicaID:         ci.ReplicaID,
+			LeaderID:          ci.LeaderID,
+			Term:              ci.Term,
+			IsLeader:          ci.LeaderID != 0 && ci.LeaderID == ci.ReplicaID,
+			IsNonVoting:       ci.IsNonVoting,
+			IsWitness:         ci.IsWitness,
+			Pending:           ci.Pending,
+			ConfigChangeIndex: ci.ConfigChangeIndex,
+			Members:           ci.Replicas,
+		}
+		if lr, err := h.NodeHost.GetLogReader(ci.ShardID); err == nil {
+			ss.FirstIndex, ss.LastIndex = lr.GetRange()
+		}
+		if h.AppliedIndex != nil {
+			if applied, err := h.AppliedIndex(ci.ShardID); err == nil {
+				ss.AppliedIndex = &applied
+			}
+		}
+		s.Shards = append(s.Shards, ss)
+	}
+	return s
+}
+
+// Ready returns an error describing the first shard that is not ready.
+func (h *Handler) Ready() error {
+	info := h.NodeHost.GetNodeHostInfo(dragonboat.NodeHostInfoOption{SkipLogInfo: true})
+	if len(info.ShardInfoList) == 0 {
+		return fmt.Errorf("no shard")
+	}
+	timeout := h.ReadyTimeout
+	if timeout == 0 {
+		timeout = defaultReadyTimeout
+	}
+	for _, ci := range info.ShardInfoList {
+		if _, _, valid, err := h.NodeHost.GetLeaderID(ci.ShardID); err != nil || !valid {
+			return fmt.Errorf("shard %d has no leader", ci.ShardID)
+		}
+		// the read index request completes once the local replica has applied
+		// all entries up to the read index
+		rs, err := h.NodeHost.ReadIndex(ci.ShardID, timeout)
+		if errors.Is(err, dragonboat.ErrInvalidOperation) {
+			// witnesses reject read index requests as they don't apply
+			// entries, they are ready once the shard has a leader. IsWitness
+			// of the shard info can't be used, it is only set by applying the
+			// membership.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("shard %d read index failed, %v", ci.ShardID, err)
+		}
+		result := <-rs.ResultC()
+		rs.Release()
+		if !result.Completed() {
+			return fmt.Errorf("shard %d has not caught up with its read index", ci.ShardID)
+		}
+	}
+	return nil
+}